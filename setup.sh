@@ -1,9 +1,13 @@
 #!/bin/bash
 
+set -e
+
+: "${SIGNING_KEY_FILE:?set SIGNING_KEY_FILE to the base64 encoded ed25519 seed the buildpack is signed with}"
+
 rm -f buildpack.zip
 
-zip -r buildpack.zip .
+go run -mod=vendor ./src/spire/packager/cli -key "$SIGNING_KEY_FILE" -out buildpack.zip "$@"
 
 cf create-buildpack spire-agent-sidecar_buildpack buildpack.zip 1
 
-rm -f buildpack.zip
\ No newline at end of file
+rm -f buildpack.zip
@@ -0,0 +1,208 @@
+package checksums
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	ManifestName  = "checksums.txt"
+	SignatureName = "checksums.txt.sig"
+)
+
+// PublicKey is the base64 encoded ed25519 key the checksum manifest is signed
+// with. Operators who sign their own buildpack builds replace it with
+// `-ldflags "-X github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums.PublicKey=<key>"`.
+var PublicKey = "+RIo/WXwJ8Js/LrfL2RVG05ikhv7dadTptYICsFO+4w="
+
+// Signed lists the buildpack files and directories covered by the manifest.
+// Every file found under them must be listed.
+var Signed = []string{"manifest.yml", "bin", "binaries", "certificates", "dependencies", "templates"}
+
+// ErrUnsigned is returned for a buildpack without a checksum manifest, such
+// as a git checkout that was not built by the packager.
+var ErrUnsigned = errors.New("the buildpack has no checksum manifest")
+
+// FileError names the buildpack file that failed verification.
+type FileError struct {
+	Path   string
+	Reason string
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("`%s` %s", e.Path, e.Reason)
+}
+
+// Generate returns a manifest in `sha256sum` format for the signed files
+// found under root.
+func Generate(root string) ([]byte, error) {
+	files, err := list(root, Signed)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for _, file := range files {
+		sum, err := SHA256File(filepath.Join(root, file))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&out, "%s  %s\n", sum, file)
+	}
+	return out.Bytes(), nil
+}
+
+// Sign returns the base64 encoded signature of manifest.
+func Sign(manifest []byte, seed []byte) ([]byte, error) {
+	if err := checkSeed(seed); err != nil {
+		return nil, err
+	}
+	signature := ed25519.Sign(ed25519.NewKeyFromSeed(seed), manifest)
+	return []byte(base64.StdEncoding.EncodeToString(signature) + "\n"), nil
+}
+
+// PublicKeyFromSeed returns the base64 encoded public key matching seed, in
+// the form PublicKey expects.
+func PublicKeyFromSeed(seed []byte) (string, error) {
+	if err := checkSeed(seed); err != nil {
+		return "", err
+	}
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func checkSeed(seed []byte) error {
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("signing key must be a %d byte ed25519 seed", ed25519.SeedSize)
+	}
+	return nil
+}
+
+// Verify checks the manifest signature under root against publicKey and then
+// the SHA-256 of every listed file. It returns the verified file names.
+func Verify(root string, publicKey string) ([]string, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("embedded checksum public key is not a base64 encoded ed25519 key")
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(root, ManifestName))
+	if os.IsNotExist(err) {
+		return nil, ErrUnsigned
+	} else if err != nil {
+		return nil, err
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(root, SignatureName))
+	if os.IsNotExist(err) {
+		return nil, &FileError{Path: SignatureName, Reason: "is missing"}
+	} else if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), manifest, signature) {
+		return nil, &FileError{Path: ManifestName, Reason: "does not match its signature"}
+	}
+
+	sums, err := parse(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var verified []string
+	for _, file := range utils.SortedKeys(sums) {
+		sum, err := SHA256File(filepath.Join(root, file))
+		if os.IsNotExist(err) {
+			return nil, &FileError{Path: file, Reason: "is listed in the checksum manifest but missing"}
+		} else if err != nil {
+			return nil, &FileError{Path: file, Reason: err.Error()}
+		}
+		if sum != sums[file] {
+			return nil, &FileError{Path: file, Reason: fmt.Sprintf("has sha256 %s, expected %s", sum, sums[file])}
+		}
+		verified = append(verified, file)
+	}
+
+	present, err := list(root, Signed)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range present {
+		if _, ok := sums[file]; !ok {
+			return nil, &FileError{Path: file, Reason: "is not listed in the checksum manifest"}
+		}
+	}
+
+	return verified, nil
+}
+
+func parse(manifest []byte) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, &FileError{Path: ManifestName, Reason: fmt.Sprintf("has an invalid entry on line %d", line)}
+		}
+		sums[filepath.Clean(fields[1])] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+func list(root string, paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.Walk(filepath.Join(root, path), func(file string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// SHA256File returns the hex encoded SHA-256 of the file at path.
+func SHA256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,175 @@
+package checksums
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// signedBuildpack writes a small buildpack under a temp dir, signs it and
+// returns the dir and the base64 encoded public key.
+func signedBuildpack(t *testing.T) (string, string) {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"manifest.yml":                 "language: spire-agent\n",
+		"VERSION":                      "1.0.0\n",
+		"bin/supply":                   "#!/bin/bash\n",
+		"binaries/spire-agent":         "agent",
+		"certificates/bundle.crt":      "bundle",
+		"templates/spire-agent.tmpl":   "template",
+		"dependencies/cf_iic-1/cf_iic": "plugin",
+	} {
+		testutil.WriteFile(t, filepath.Join(root, name), content, 0644)
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Generate(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := Sign(manifest, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(root, ManifestName), string(manifest), 0644)
+	testutil.WriteFile(t, filepath.Join(root, SignatureName), string(signature), 0644)
+
+	publicKey, err := PublicKeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, publicKey
+}
+
+func TestVerify(t *testing.T) {
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, root string)
+		key      string
+		wantPath string
+		wantErr  error
+	}{
+		{
+			name: "untouched",
+		},
+		{
+			name: "modified binary",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "binaries/spire-agent"), "tampered", 0644)
+			},
+			wantPath: "binaries/spire-agent",
+		},
+		{
+			name: "unlisted certificate",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "certificates/extra.crt"), "extra", 0644)
+			},
+			wantPath: "certificates/extra.crt",
+		},
+		{
+			name: "unlisted template",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "templates/extra.tmpl"), "extra", 0644)
+			},
+			wantPath: "templates/extra.tmpl",
+		},
+		{
+			name: "missing listed file",
+			change: func(t *testing.T, root string) {
+				if err := os.Remove(filepath.Join(root, "dependencies/cf_iic-1/cf_iic")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantPath: "dependencies/cf_iic-1/cf_iic",
+		},
+		{
+			name:     "modified manifest",
+			change:   func(t *testing.T, root string) { testutil.WriteFile(t, filepath.Join(root, ManifestName), "", 0644) },
+			wantPath: ManifestName,
+		},
+		{
+			name:     "signed by another key",
+			key:      base64.StdEncoding.EncodeToString(otherKey),
+			wantPath: ManifestName,
+		},
+		{
+			name: "missing signature",
+			change: func(t *testing.T, root string) {
+				if err := os.Remove(filepath.Join(root, SignatureName)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantPath: SignatureName,
+		},
+		{
+			name: "unsigned",
+			change: func(t *testing.T, root string) {
+				for _, name := range []string{ManifestName, SignatureName} {
+					if err := os.Remove(filepath.Join(root, name)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			wantErr: ErrUnsigned,
+		},
+		{
+			name: "unsigned files outside the signed paths",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "README.md"), "readme", 0644)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, key := signedBuildpack(t)
+			if tt.key != "" {
+				key = tt.key
+			}
+			if tt.change != nil {
+				tt.change(t, root)
+			}
+
+			files, err := Verify(root, key)
+
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			case tt.wantPath != "":
+				var fileErr *FileError
+				if !errors.As(err, &fileErr) || fileErr.Path != filepath.FromSlash(tt.wantPath) {
+					t.Fatalf("expected a failure for `%s`, got %v", tt.wantPath, err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case len(files) != 6:
+				t.Fatalf("expected 6 verified files, got %v", files)
+			}
+		})
+	}
+}
+
+func TestSignRejectsShortSeed(t *testing.T) {
+	if _, err := Sign([]byte("manifest"), []byte("short")); err == nil {
+		t.Fatal("expected an error for a seed that is not 32 bytes")
+	}
+	if _, err := PublicKeyFromSeed([]byte("short")); err == nil {
+		t.Fatal("expected an error for a seed that is not 32 bytes")
+	}
+}
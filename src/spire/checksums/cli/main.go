@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	buildpackDir := flag.String("buildpack-dir", ".", "buildpack root directory")
+	keyFile := flag.String("key", "", "file containing the base64 encoded ed25519 seed to sign the checksum manifest with")
+	verify := flag.Bool("verify", false, "verify the checksum manifest with the embedded public key instead of writing it")
+	flag.Parse()
+
+	os.Exit(run(*buildpackDir, *keyFile, *verify))
+}
+
+func run(buildpackDir, keyFile string, verify bool) int {
+	if verify {
+		files, err := checksums.Verify(buildpackDir, checksums.PublicKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Checksum verification failed: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Verified %d file(s)\n", len(files))
+		return 0
+	}
+
+	if keyFile == "" {
+		fmt.Fprintln(os.Stderr, "Missing required `-key` flag")
+		flag.Usage()
+		return 2
+	}
+	encoded, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read signing key: %s\n", err.Error())
+		return 2
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Signing key is not base64 encoded: %s\n", err.Error())
+		return 2
+	}
+
+	manifest, err := checksums.Generate(buildpackDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to generate checksum manifest: %s\n", err.Error())
+		return 1
+	}
+	signature, err := checksums.Sign(manifest, seed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to sign checksum manifest: %s\n", err.Error())
+		return 1
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(buildpackDir, checksums.ManifestName), manifest, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write checksum manifest: %s\n", err.Error())
+		return 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(buildpackDir, checksums.SignatureName), signature, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write checksum signature: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Signed checksums of %d file(s)\n", strings.Count(string(manifest), "\n"))
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/cnb"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"path/filepath"
+)
+
+// bin/detect and bin/build are both links to this binary, the phase is taken
+// from the name it is invoked with
+func main() {
+	logger := libbuildpack.NewLogger(supply.NewRedactingWriter(os.Stdout))
+
+	appDir, err := os.Getwd()
+	if err != nil {
+		logger.Error("Unable to determine application directory: %s", err.Error())
+		os.Exit(1)
+	}
+
+	buildpackDir := os.Getenv("CNB_BUILDPACK_DIR")
+	if buildpackDir == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			logger.Error("Unable to determine buildpack directory: %s", err.Error())
+			os.Exit(1)
+		}
+		buildpackDir = filepath.Dir(filepath.Dir(executable))
+	}
+
+	switch phase := filepath.Base(os.Args[0]); phase {
+	case "detect":
+		if len(os.Args) < 3 {
+			logger.Error("Usage: detect <platform> <plan>")
+			os.Exit(1)
+		}
+		code, err := cnb.Detect(appDir, os.Args[1], os.Args[2])
+		if err != nil {
+			logger.Error("Unable to detect: %s", err.Error())
+		}
+		os.Exit(code)
+	case "build":
+		if len(os.Args) < 4 {
+			logger.Error("Usage: build <layers> <platform> <plan>")
+			os.Exit(1)
+		}
+		builder := &cnb.Builder{
+			BuildpackDir: buildpackDir,
+			AppDir:       appDir,
+			LayersDir:    os.Args[1],
+			PlatformDir:  os.Args[2],
+			Log:          logger,
+		}
+		if err := builder.Build(); err != nil {
+			code := supply.ExitCode(err)
+			if code == supply.UnknownFailureExitCode {
+				logger.Error("Build failed: %s", err.Error())
+			}
+			os.Exit(code)
+		}
+	default:
+		logger.Error("Unknown phase `%s`; invoke as detect or build", phase)
+		os.Exit(1)
+	}
+}
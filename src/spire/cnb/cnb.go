@@ -0,0 +1,128 @@
+package cnb
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/render"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	agentLayer  = "spire-agent"
+	configLayer = "spire-config"
+
+	spireEnvoyBinaryEnv = "SPIRE_ENVOY_BINARY"
+)
+
+var configFiles = []string{"spire-agent.conf", "envoy-config.yaml"}
+
+const (
+	DetectPass = 0
+	DetectFail = 100
+)
+
+func Detect(appDir, platformDir, planPath string) (int, error) {
+	if err := loadPlatformEnv(platformDir); err != nil {
+		return DetectFail, err
+	}
+
+	detected, err := supply.Detect(appDir)
+	if err != nil {
+		return DetectFail, err
+	} else if !detected {
+		return DetectFail, nil
+	}
+
+	if err := writeBuildPlan(planPath); err != nil {
+		return DetectFail, err
+	}
+	return DetectPass, nil
+}
+
+type Builder struct {
+	BuildpackDir string
+	AppDir       string
+	LayersDir    string
+	PlatformDir  string
+	Log          *libbuildpack.Logger
+}
+
+func (b *Builder) Build() error {
+	if err := loadPlatformEnv(b.PlatformDir); err != nil {
+		return err
+	}
+
+	manifest, err := NewManifest(b.BuildpackDir)
+	if err != nil {
+		return err
+	}
+
+	stager := render.NewStager(b.LayersDir, agentLayer, b.AppDir)
+	if err := os.MkdirAll(stager.DepDir(), 0755); err != nil {
+		return err
+	}
+
+	supplier := supply.New(stager, manifest, NewInstaller(manifest, b.Log), b.Log, &libbuildpack.Command{})
+	// layers are mounted at the same path at build and at launch
+	supplier.RuntimeDepsDir = b.LayersDir
+	if err := supplier.Run(); err != nil {
+		return err
+	}
+
+	if err := b.contributeConfigLayer(stager); err != nil {
+		return err
+	}
+
+	if err := writeLaunchEnv(stager.DepDir(), "SPIFFE_ENDPOINT_SOCKET", "unix://"+supply.AgentSocketPath); err != nil {
+		return err
+	}
+
+	if err := writeLayerMetadata(b.LayersDir, agentLayer, true); err != nil {
+		return err
+	}
+
+	return writeLaunchMetadata(b.LayersDir, b.processes(stager, supplier))
+}
+
+func (b *Builder) contributeConfigLayer(stager *render.Stager) error {
+	layerDir := filepath.Join(b.LayersDir, configLayer)
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		return err
+	}
+
+	for _, name := range configFiles {
+		src := filepath.Join(stager.DepDir(), name)
+		if exists, err := libbuildpack.FileExists(src); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(layerDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return writeLayerMetadata(b.LayersDir, configLayer, true)
+}
+
+func (b *Builder) processes(stager *render.Stager, supplier *supply.Supplier) []Process {
+	configDir := filepath.Join(b.LayersDir, configLayer)
+	processes := []Process{{
+		Type:    "spire-agent",
+		Command: filepath.Join(stager.DepDir(), "bin", "spire-agent"),
+		Args:    []string{"run", "-config", filepath.Join(configDir, "spire-agent.conf")},
+	}}
+
+	if supplier.EnvoyProxy() {
+		processes = append(processes, Process{
+			Type:    "envoy-proxy",
+			Command: utils.EnvWithDefault(spireEnvoyBinaryEnv, "envoy"),
+			Args:    []string{"-c", filepath.Join(configDir, "envoy-config.yaml"), "--base-id", strconv.FormatUint(uint64(supply.EnvoyBaseID()), 10)},
+		})
+	}
+
+	return processes
+}
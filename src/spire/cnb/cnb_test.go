@@ -0,0 +1,229 @@
+package cnb
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cnbRoot lays out a signed CNB root the way the packager does, with the
+// repository templates and certificates.
+func cnbRoot(t *testing.T) string {
+	t.Helper()
+	root := testutil.Buildpack(t)
+
+	seed := make([]byte, 32)
+	publicKey, err := checksums.PublicKeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := checksums.PublicKey
+	t.Cleanup(func() { checksums.PublicKey = original })
+	checksums.PublicKey = publicKey
+
+	manifest, err := checksums.Generate(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := checksums.Sign(manifest, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(root, checksums.ManifestName), string(manifest), 0644)
+	testutil.WriteFile(t, filepath.Join(root, checksums.SignatureName), string(signature), 0644)
+	return root
+}
+
+// platformDir writes env as the CNB platform does, one file per variable.
+// The variables are reset after the test as Build exports them.
+func platformDir(t *testing.T, env map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for key, value := range env {
+		t.Setenv(key, "")
+		testutil.WriteFile(t, filepath.Join(dir, "env", key), value, 0644)
+	}
+	return dir
+}
+
+func TestBuildLayers(t *testing.T) {
+	vcapApplication := `{"application_id":"2d2e3b5c-8c1f-4d4e-9c2a-6f0e5b1a7d31","application_name":"app"}`
+	server := map[string]string{"SPIRE_SERVER_ADDRESS": "spire-server", "SPIRE_SERVER_PORT": "8081", "SPIRE_TRUST_DOMAIN": "example.org"}
+	with := func(env map[string]string) map[string]string {
+		merged := map[string]string{}
+		for _, m := range []map[string]string{server, env} {
+			for key, value := range m {
+				merged[key] = value
+			}
+		}
+		return merged
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		change      func(t *testing.T, root string)
+		wantEnvoy   bool
+		wantErrKind supply.ErrorKind
+	}{
+		{
+			name: "agent only",
+			env:  with(nil),
+		},
+		{
+			name:      "agent and envoy",
+			env:       with(map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app", "VCAP_APPLICATION": vcapApplication}),
+			wantEnvoy: true,
+		},
+		{
+			name: "envoy step skipped",
+			env:  with(map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_SKIP_STEPS": "envoy"}),
+		},
+		{
+			name:        "missing server address",
+			env:         map[string]string{"SPIRE_SERVER_PORT": "8081", "SPIRE_TRUST_DOMAIN": "example.org"},
+			wantErrKind: supply.MissingConfiguration,
+		},
+		{
+			name: "modified template",
+			env:  with(nil),
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "templates", "spire-agent-conf.tmpl"), "tampered", 0644)
+			},
+			wantErrKind: supply.ChecksumVerificationFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"SPIRE_SERVER_ADDRESS", "SPIRE_SERVER_PORT", "SPIRE_TRUST_DOMAIN", "SPIRE_ENVOY_PROXY", "SPIRE_SKIP_STEPS", "SPIRE_APPLICATION_SPIFFE_ID", "VCAP_APPLICATION"} {
+				t.Setenv(key, "")
+			}
+			root := cnbRoot(t)
+			if tt.change != nil {
+				tt.change(t, root)
+			}
+			layersDir := t.TempDir()
+
+			b := &Builder{
+				BuildpackDir: root,
+				AppDir:       t.TempDir(),
+				LayersDir:    layersDir,
+				PlatformDir:  platformDir(t, tt.env),
+				Log:          libbuildpack.NewLogger(ioutil.Discard),
+			}
+			err := b.Build()
+
+			if tt.wantErrKind != 0 {
+				if supply.ExitCode(err) != tt.wantErrKind.ExitCode() {
+					t.Fatalf("expected a %s error, got %v", tt.wantErrKind, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			agentDir := filepath.Join(layersDir, agentLayer)
+			configDir := filepath.Join(layersDir, configLayer)
+			for _, path := range []string{
+				filepath.Join(agentDir, "bin", "spire-agent"),
+				filepath.Join(agentDir, "bin", "cf_iic"),
+				filepath.Join(agentDir, "bin", "svidstore-cf"),
+				filepath.Join(agentDir, "config.yml"),
+				filepath.Join(configDir, "spire-agent.conf"),
+			} {
+				if _, err := os.Stat(path); err != nil {
+					t.Errorf("expected %s: %v", path, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(agentDir, "spire-agent.conf")); !os.IsNotExist(err) {
+				t.Errorf("expected spire-agent.conf to be moved to the config layer, got %v", err)
+			}
+			_, err = os.Stat(filepath.Join(configDir, "envoy-config.yaml"))
+			if tt.wantEnvoy != (err == nil) {
+				t.Errorf("expected envoy-config.yaml in the config layer: %t, got %v", tt.wantEnvoy, err)
+			}
+
+			for _, layer := range []string{agentLayer, configLayer} {
+				metadata, err := ioutil.ReadFile(filepath.Join(layersDir, layer+".toml"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(metadata), "[types]\nlaunch = true\n") {
+					t.Errorf("expected %s to be a launch layer, got:\n%s", layer, metadata)
+				}
+			}
+
+			socket, err := ioutil.ReadFile(filepath.Join(agentDir, "env.launch", "SPIFFE_ENDPOINT_SOCKET.override"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(socket) != "unix://"+supply.AgentSocketPath {
+				t.Errorf("expected SPIFFE_ENDPOINT_SOCKET to point at the agent socket, got %s", socket)
+			}
+
+			launch, err := ioutil.ReadFile(filepath.Join(layersDir, "launch.toml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			agentProcess := fmt.Sprintf("type = \"spire-agent\"\ncommand = %q\nargs = [\"run\", \"-config\", %q]\n",
+				filepath.Join(agentDir, "bin", "spire-agent"), filepath.Join(configDir, "spire-agent.conf"))
+			if !strings.Contains(string(launch), agentProcess) {
+				t.Errorf("expected the spire-agent process, got:\n%s", launch)
+			}
+			if strings.Contains(string(launch), `type = "envoy-proxy"`) != tt.wantEnvoy {
+				t.Errorf("expected an envoy-proxy process: %t, got:\n%s", tt.wantEnvoy, launch)
+			}
+			if baseID := fmt.Sprintf(`"--base-id", "%d"`, supply.EnvoyBaseID()); tt.wantEnvoy && (supply.EnvoyBaseID() == 1 || !strings.Contains(string(launch), baseID)) {
+				t.Errorf("expected the envoy-proxy process to use the app's base id %s, got:\n%s", baseID, launch)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantCode int
+	}{
+		{
+			name:     "server configured",
+			env:      map[string]string{"SPIRE_SERVER_ADDRESS": "spire-server"},
+			wantCode: DetectPass,
+		},
+		{
+			name:     "not configured",
+			wantCode: DetectFail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"SPIRE_SERVER_ADDRESS", "SPIRE_SERVER_PORT", "SPIRE_TRUST_DOMAIN"} {
+				t.Setenv(key, "")
+			}
+			planPath := filepath.Join(t.TempDir(), "plan.toml")
+
+			code, err := Detect(t.TempDir(), platformDir(t, tt.env), planPath)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("expected detect to exit %d, got %d", tt.wantCode, code)
+			}
+			_, err = os.Stat(planPath)
+			if (tt.wantCode == DetectPass) != (err == nil) {
+				t.Fatalf("expected a build plan only when detected, got %v", err)
+			}
+		})
+	}
+}
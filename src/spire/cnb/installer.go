@@ -0,0 +1,99 @@
+package cnb
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+type Installer struct {
+	manifest *Manifest
+	log      *libbuildpack.Logger
+}
+
+func NewInstaller(manifest *Manifest, logger *libbuildpack.Logger) *Installer {
+	return &Installer{manifest: manifest, log: logger}
+}
+
+func (i *Installer) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	i.log.BeginStep("Installing %s %s", dep.Name, dep.Version)
+
+	entry, err := i.manifest.GetEntry(dep)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	outputFile := filepath.Join(outputDir, filepath.Base(entry.URI))
+
+	if entry.File != "" {
+		source := entry.File
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(i.manifest.RootDir(), source)
+		}
+		if exists, err := libbuildpack.FileExists(source); err != nil {
+			return err
+		} else if exists {
+			i.log.Info("Copy [%s]", source)
+			if err := libbuildpack.CopyFile(source, outputFile); err != nil {
+				return err
+			}
+			return i.checkSha256(entry, outputFile)
+		}
+	}
+
+	i.log.Info("Download [%s]", entry.URI)
+	if err := download(entry.URI, outputFile); err != nil {
+		return err
+	}
+	return i.checkSha256(entry, outputFile)
+}
+
+func (i *Installer) InstallOnlyVersion(depName string, installDir string) error {
+	versions := i.manifest.AllDependencyVersions(depName)
+	if len(versions) != 1 {
+		return fmt.Errorf("expected exactly one version of %s, found %d", depName, len(versions))
+	}
+	return i.InstallDependency(libbuildpack.Dependency{Name: depName, Version: versions[0]}, installDir)
+}
+
+func (i *Installer) checkSha256(entry *libbuildpack.ManifestEntry, file string) error {
+	if err := libbuildpack.CheckSha256(file, entry.SHA256); err != nil {
+		os.Remove(file)
+		return err
+	}
+	return nil
+}
+
+func download(url, destFile string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("could not download %s: %d", url, resp.StatusCode)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(destFile), ".download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destFile)
+}
@@ -0,0 +1,73 @@
+package cnb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Process struct {
+	Type    string
+	Command string
+	Args    []string
+	Default bool
+}
+
+func writeLayerMetadata(layersDir, name string, launch bool) error {
+	content := fmt.Sprintf("[types]\nlaunch = %t\nbuild = false\ncache = false\n", launch)
+	return ioutil.WriteFile(filepath.Join(layersDir, name+".toml"), []byte(content), 0644)
+}
+
+func writeLaunchMetadata(layersDir string, processes []Process) error {
+	var b strings.Builder
+	for _, p := range processes {
+		args := make([]string, len(p.Args))
+		for i, arg := range p.Args {
+			args[i] = strconv.Quote(arg)
+		}
+		fmt.Fprintf(&b, "[[processes]]\ntype = %s\ncommand = %s\nargs = [%s]\ndirect = true\ndefault = %t\n\n", strconv.Quote(p.Type), strconv.Quote(p.Command), strings.Join(args, ", "), p.Default)
+	}
+	return ioutil.WriteFile(filepath.Join(layersDir, "launch.toml"), []byte(b.String()), 0644)
+}
+
+func writeBuildPlan(planPath string) error {
+	content := "[[provides]]\nname = \"spire-agent\"\n\n[[requires]]\nname = \"spire-agent\"\n"
+	return ioutil.WriteFile(planPath, []byte(content), 0644)
+}
+
+func writeLaunchEnv(layerDir, name, value string) error {
+	envDir := filepath.Join(layerDir, "env.launch")
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(envDir, name+".override"), []byte(value), 0644)
+}
+
+// loadPlatformEnv exports the user provided environment, which the CNB
+// platform passes as one file per variable in <platform>/env.
+func loadPlatformEnv(platformDir string) error {
+	envDir := filepath.Join(platformDir, "env")
+	files, err := ioutil.ReadDir(envDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(envDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.Setenv(file.Name(), string(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package cnb
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"path/filepath"
+)
+
+// Manifest reads the CF manifest.yml but ignores cf_stacks, CNB stacks are
+// declared in buildpack.toml instead.
+type Manifest struct {
+	DefaultVersions []libbuildpack.Dependency    `yaml:"default_versions"`
+	ManifestEntries []libbuildpack.ManifestEntry `yaml:"dependencies"`
+	rootDir         string
+}
+
+func NewManifest(rootDir string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(rootDir, "manifest.yml"), m); err != nil {
+		return nil, err
+	}
+	m.rootDir = rootDir
+	return m, nil
+}
+
+func (m *Manifest) DefaultVersion(depName string) (libbuildpack.Dependency, error) {
+	for _, dep := range m.DefaultVersions {
+		if dep.Name != depName {
+			continue
+		}
+		version, err := libbuildpack.FindMatchingVersion(dep.Version, m.AllDependencyVersions(depName))
+		if err != nil {
+			return libbuildpack.Dependency{}, err
+		}
+		return libbuildpack.Dependency{Name: depName, Version: version}, nil
+	}
+	return libbuildpack.Dependency{}, fmt.Errorf("no default version for %s", depName)
+}
+
+func (m *Manifest) AllDependencyVersions(depName string) []string {
+	var versions []string
+	for _, entry := range m.ManifestEntries {
+		if entry.Dependency.Name == depName {
+			versions = append(versions, entry.Dependency.Version)
+		}
+	}
+	return versions
+}
+
+func (m *Manifest) GetEntry(dep libbuildpack.Dependency) (*libbuildpack.ManifestEntry, error) {
+	for _, entry := range m.ManifestEntries {
+		if entry.Dependency == dep {
+			e := entry
+			return &e, nil
+		}
+	}
+	return nil, fmt.Errorf("dependency %s %s not found", dep.Name, dep.Version)
+}
+
+func (m *Manifest) RootDir() string {
+	return m.rootDir
+}
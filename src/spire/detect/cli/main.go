@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"time"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(os.Stderr)
+
+	if len(os.Args) < 2 {
+		logger.Error("Usage: detect <build-dir>")
+		os.Exit(2)
+	}
+
+	detected, err := supply.Detect(os.Args[1])
+	if err != nil {
+		logger.Error("Unable to detect: %s", err.Error())
+		os.Exit(1)
+	}
+	if !detected {
+		os.Exit(1)
+	}
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		logger.Error("Unable to determine buildpack directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		os.Exit(10)
+	}
+
+	version, err := manifest.Version()
+	if err != nil {
+		logger.Error("Unable to determine buildpack version: %s", err.Error())
+		os.Exit(10)
+	}
+
+	fmt.Printf("%s %s\n", manifest.Language(), version)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/doctor"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	depDir := flag.String("dep-dir", "", "buildpack deps directory; defaults to the parent of this binary's directory")
+	flag.Parse()
+
+	if *depDir == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to determine deps directory: %s\n", err.Error())
+			os.Exit(2)
+		}
+		*depDir = filepath.Dir(filepath.Dir(executable))
+	}
+
+	if !doctor.Report(os.Stdout, doctor.New(*depDir, supply.EnvoyProxyEnabled()).Run()) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,225 @@
+package doctor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	dialTimeout        = 3 * time.Second
+	serverAddressRegex = `(?m)^\s*server_address\s*=\s*("(?:[^"\\]|\\.)+")`
+	serverPortRegex    = `(?m)^\s*server_port\s*=\s*"?(\d+)"?`
+)
+
+type Result struct {
+	Name   string
+	Passed bool
+	Detail string
+	Hint   string
+}
+
+type Doctor struct {
+	DepDir      string
+	SocketPath  string
+	CertPath    string
+	KeyPath     string
+	EnvoyConfig bool
+	Now         time.Time
+}
+
+func New(depDir string, envoyConfig bool) *Doctor {
+	return &Doctor{
+		DepDir:      depDir,
+		SocketPath:  supply.AgentSocketPath,
+		CertPath:    supply.InstanceCertPath,
+		KeyPath:     supply.InstanceKeyPath,
+		EnvoyConfig: envoyConfig,
+		Now:         time.Now(),
+	}
+}
+
+func (d *Doctor) Run() []Result {
+	results := []Result{
+		d.CheckAgentSocket(),
+		d.CheckInstanceCredentials(),
+		d.CheckTrustBundle(),
+		d.CheckServer(),
+	}
+	if d.EnvoyConfig {
+		results = append(results, d.CheckEnvoyConfig())
+	}
+	return results
+}
+
+func (d *Doctor) CheckAgentSocket() Result {
+	r := Result{Name: "agent socket"}
+	if _, err := os.Stat(d.SocketPath); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "check that the spire_agent sidecar is running (`cf app` lists sidecars) and look for startup errors in `cf logs`"
+		return r
+	}
+
+	conn, err := net.DialTimeout("unix", d.SocketPath, dialTimeout)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "the socket exists but nothing answers; the agent probably crashed, check `cf logs` for spire_agent errors"
+		return r
+	}
+	conn.Close()
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("%s answers", d.SocketPath)
+	return r
+}
+
+func (d *Doctor) CheckInstanceCredentials() Result {
+	r := Result{Name: "instance identity credentials"}
+	pair, err := tls.LoadX509KeyPair(d.CertPath, d.KeyPath)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "instance identity credentials must be enabled on the Diego cell; ask your platform operator"
+		return r
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "the instance identity certificate is corrupt; restart the app to get a new one"
+		return r
+	}
+	if d.Now.After(cert.NotAfter) {
+		r.Detail = fmt.Sprintf("%s expired at %s", d.CertPath, cert.NotAfter.Format(time.RFC3339))
+		r.Hint = "Diego rotates instance credentials automatically; restart the app instance if rotation stopped"
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("valid until %s", cert.NotAfter.Format(time.RFC3339))
+	return r
+}
+
+func (d *Doctor) CheckTrustBundle() Result {
+	r := Result{Name: "trust bundle"}
+	path := filepath.Join(d.DepDir, "certificates", "bundle.crt")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "restage the app so the buildpack installs the trust bundle"
+		return r
+	}
+
+	count := 0
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			r.Detail = fmt.Sprintf("%s: %s", path, err.Error())
+			r.Hint = "the trust bundle contains an invalid certificate; fix the bundle and restage"
+			return r
+		}
+		count++
+	}
+	if count == 0 {
+		r.Detail = fmt.Sprintf("%s contains no certificates", path)
+		r.Hint = "the trust bundle must contain the PEM encoded SPIRE server CA; fix the bundle and restage"
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("%d certificate(s) in %s", count, path)
+	return r
+}
+
+func (d *Doctor) CheckServer() Result {
+	r := Result{Name: "spire server"}
+	address, port, err := d.serverAddress()
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "restage the app with SPIRE_SERVER_ADDRESS and SPIRE_SERVER_PORT set"
+		return r
+	}
+
+	if _, err := net.LookupHost(address); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "the SPIRE server address does not resolve; check SPIRE_SERVER_ADDRESS and the space's DNS"
+		return r
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, port), dialTimeout)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "the SPIRE server does not accept connections; check SPIRE_SERVER_PORT and the space's egress security groups"
+		return r
+	}
+	conn.Close()
+
+	r.Passed = true
+	r.Detail = fmt.Sprintf("%s accepts TCP", net.JoinHostPort(address, port))
+	return r
+}
+
+func (d *Doctor) serverAddress() (string, string, error) {
+	path := filepath.Join(d.DepDir, "spire-agent.conf")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	address := regexp.MustCompile(serverAddressRegex).FindSubmatch(content)
+	port := regexp.MustCompile(serverPortRegex).FindSubmatch(content)
+	if address == nil || port == nil {
+		return "", "", fmt.Errorf("%s does not set server_address and server_port", path)
+	}
+	// supply renders server_address as a quoted HCL string
+	unquoted, err := strconv.Unquote(string(address[1]))
+	if err != nil {
+		return "", "", fmt.Errorf("%s has an invalid server_address: %s", path, err.Error())
+	}
+	return unquoted, string(port[1]), nil
+}
+
+func (d *Doctor) CheckEnvoyConfig() Result {
+	r := Result{Name: "envoy config"}
+	path := filepath.Join(d.DepDir, "envoy-config.yaml")
+	if info, err := os.Stat(path); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "restage the app with SPIRE_ENVOY_PROXY=true and SPIRE_APPLICATION_SPIFFE_ID set"
+		return r
+	} else if info.Size() == 0 {
+		r.Detail = fmt.Sprintf("%s is empty", path)
+		r.Hint = "a previous staging failed while rendering the Envoy config; restage the app"
+		return r
+	}
+
+	r.Passed = true
+	r.Detail = path
+	return r
+}
+
+func Report(w io.Writer, results []Result) bool {
+	passed := true
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+			passed = false
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, r.Name, r.Detail)
+		if !r.Passed && r.Hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", r.Hint)
+		}
+	}
+	return passed
+}
@@ -0,0 +1,311 @@
+package doctor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCredentials writes a self-signed CA certificate and its key to dir and
+// returns their paths.
+func writeCredentials(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             notAfter.Add(-24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "instance.crt")
+	keyPath := filepath.Join(dir, "instance.key")
+	testutil.WriteFile(t, certPath, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), 0644)
+	testutil.WriteFile(t, keyPath, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), 0600)
+	return certPath, keyPath
+}
+
+// shortTempDir returns a temp dir short enough to hold a unix socket.
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func checkResult(t *testing.T, r Result, wantPassed bool, wantHint string) {
+	t.Helper()
+	if r.Passed != wantPassed {
+		t.Fatalf("expected passed %t, got %+v", wantPassed, r)
+	}
+	if wantPassed && r.Hint != "" {
+		t.Fatalf("expected no hint for a passed check, got %q", r.Hint)
+	}
+	if !strings.Contains(r.Hint, wantHint) {
+		t.Fatalf("expected a hint containing %q, got %q", wantHint, r.Hint)
+	}
+}
+
+func TestCheckAgentSocket(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, path string)
+		wantPassed bool
+		wantHint   string
+	}{
+		{
+			name:     "missing socket",
+			setup:    func(t *testing.T, path string) {},
+			wantHint: "check that the spire_agent sidecar is running",
+		},
+		{
+			name: "nothing listening",
+			setup: func(t *testing.T, path string) {
+				testutil.WriteFile(t, path, "", 0644)
+			},
+			wantHint: "the agent probably crashed",
+		},
+		{
+			name: "agent listening",
+			setup: func(t *testing.T, path string) {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { l.Close() })
+			},
+			wantPassed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(shortTempDir(t), "api.sock")
+			tt.setup(t, path)
+			d := &Doctor{SocketPath: path}
+			checkResult(t, d.CheckAgentSocket(), tt.wantPassed, tt.wantHint)
+		})
+	}
+}
+
+func TestCheckInstanceCredentials(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		notAfter   time.Time
+		missing    bool
+		wantPassed bool
+		wantHint   string
+	}{
+		{
+			name:     "missing credentials",
+			missing:  true,
+			wantHint: "instance identity credentials must be enabled",
+		},
+		{
+			name:     "expired certificate",
+			notAfter: now.Add(-time.Hour),
+			wantHint: "Diego rotates instance credentials automatically",
+		},
+		{
+			name:       "valid credentials",
+			notAfter:   now.Add(time.Hour),
+			wantPassed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath := filepath.Join(dir, "instance.crt"), filepath.Join(dir, "instance.key")
+			if !tt.missing {
+				certPath, keyPath = writeCredentials(t, dir, tt.notAfter)
+			}
+			d := &Doctor{CertPath: certPath, KeyPath: keyPath, Now: now}
+			checkResult(t, d.CheckInstanceCredentials(), tt.wantPassed, tt.wantHint)
+		})
+	}
+}
+
+func TestCheckTrustBundle(t *testing.T) {
+	certPath, _ := writeCredentials(t, t.TempDir(), time.Now().Add(time.Hour))
+	ca := testutil.ReadFile(t, certPath)
+
+	tests := []struct {
+		name       string
+		bundle     *string
+		wantPassed bool
+		wantHint   string
+	}{
+		{
+			name:     "missing bundle",
+			wantHint: "restage the app so the buildpack installs the trust bundle",
+		},
+		{
+			name:     "no certificates",
+			bundle:   stringPtr("not a bundle\n"),
+			wantHint: "the trust bundle must contain the PEM encoded SPIRE server CA",
+		},
+		{
+			name:     "invalid certificate",
+			bundle:   stringPtr(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}))),
+			wantHint: "the trust bundle contains an invalid certificate",
+		},
+		{
+			name:       "valid bundle",
+			bundle:     &ca,
+			wantPassed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depDir := t.TempDir()
+			if tt.bundle != nil {
+				testutil.WriteFile(t, filepath.Join(depDir, "certificates", "bundle.crt"), *tt.bundle, 0644)
+			}
+			d := &Doctor{DepDir: depDir}
+			checkResult(t, d.CheckTrustBundle(), tt.wantPassed, tt.wantHint)
+		})
+	}
+}
+
+func TestCheckServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	conf := func(address string, port int) *string {
+		c := fmt.Sprintf("agent {\n  server_address    = %q\n  server_port       = %d\n}\n", address, port)
+		return &c
+	}
+
+	tests := []struct {
+		name       string
+		conf       *string
+		wantPassed bool
+		wantHint   string
+	}{
+		{
+			name:     "missing agent config",
+			wantHint: "restage the app with SPIRE_SERVER_ADDRESS and SPIRE_SERVER_PORT set",
+		},
+		{
+			name:     "no server address",
+			conf:     stringPtr("agent {}\n"),
+			wantHint: "restage the app with SPIRE_SERVER_ADDRESS and SPIRE_SERVER_PORT set",
+		},
+		{
+			name:     "address that does not resolve",
+			conf:     conf("spire-server.invalid", port),
+			wantHint: "the SPIRE server address does not resolve",
+		},
+		{
+			name:     "server not listening",
+			conf:     conf("127.0.0.1", closedPort),
+			wantHint: "the SPIRE server does not accept connections",
+		},
+		{
+			name:       "server listening",
+			conf:       conf("127.0.0.1", port),
+			wantPassed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depDir := t.TempDir()
+			if tt.conf != nil {
+				testutil.WriteFile(t, filepath.Join(depDir, "spire-agent.conf"), *tt.conf, 0644)
+			}
+			d := &Doctor{DepDir: depDir}
+			checkResult(t, d.CheckServer(), tt.wantPassed, tt.wantHint)
+		})
+	}
+}
+
+func TestCheckEnvoyConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     *string
+		wantPassed bool
+		wantHint   string
+	}{
+		{
+			name:     "missing config",
+			wantHint: "restage the app with SPIRE_ENVOY_PROXY=true",
+		},
+		{
+			name:     "empty config",
+			config:   stringPtr(""),
+			wantHint: "a previous staging failed while rendering the Envoy config",
+		},
+		{
+			name:       "rendered config",
+			config:     stringPtr("static_resources: {}\n"),
+			wantPassed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			depDir := t.TempDir()
+			if tt.config != nil {
+				testutil.WriteFile(t, filepath.Join(depDir, "envoy-config.yaml"), *tt.config, 0644)
+			}
+			d := &Doctor{DepDir: depDir}
+			checkResult(t, d.CheckEnvoyConfig(), tt.wantPassed, tt.wantHint)
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
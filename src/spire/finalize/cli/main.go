@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/finalize"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(supply.NewRedactingWriter(os.Stdout))
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		logger.Error("Unable to determine buildpack directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		os.Exit(10)
+	}
+
+	stager := libbuildpack.NewStager(os.Args[1:], logger, manifest)
+
+	if err := stager.SetStagingEnvironment(); err != nil {
+		logger.Error("Unable to setup environment variables: %s", err.Error())
+		os.Exit(13)
+	}
+
+	supplier := supply.New(stager, manifest, libbuildpack.NewInstaller(manifest), logger, &libbuildpack.Command{})
+	finalizer := finalize.New(stager, supplier, logger)
+
+	if err := finalizer.Run(); err != nil {
+		os.Exit(supply.ExitCode(err))
+	}
+
+	stager.StagingComplete()
+}
@@ -0,0 +1,82 @@
+package finalize
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"path/filepath"
+)
+
+type Stager interface {
+	supply.Stager
+	SetLaunchEnvironment() error
+}
+
+type Finalizer struct {
+	Stager   Stager
+	Supplier *supply.Supplier
+	Log      *libbuildpack.Logger
+}
+
+func New(stager Stager, supplier *supply.Supplier, logger *libbuildpack.Logger) *Finalizer {
+	return &Finalizer{
+		Stager:   stager,
+		Supplier: supplier,
+		Log:      logger,
+	}
+}
+
+func (f *Finalizer) Run() error {
+	f.Log.BeginStep("Finalizing spire")
+
+	if err := f.Supplier.LoadConfig(); err != nil {
+		f.Log.Error("Unable to load buildpack.yml; %s", err.Error())
+		return err
+	}
+
+	if err := f.writeLaunch(); err != nil {
+		return err
+	}
+
+	if err := f.Stager.WriteProfileD("spire-agent.sh", fmt.Sprintf("export SPIFFE_ENDPOINT_SOCKET=unix://%s\n", supply.AgentSocketPath)); err != nil {
+		f.Log.Error("Failed to write spire-agent profile.d script; %s", err.Error())
+		return err
+	}
+
+	if err := f.Stager.SetLaunchEnvironment(); err != nil {
+		f.Log.Error("Unable to setup launch environment; %s", err.Error())
+		return err
+	}
+
+	if exists, err := libbuildpack.FileExists(procfilePath(f.Stager.BuildDir())); err != nil {
+		return err
+	} else if !exists {
+		f.Log.Protip("No Procfile found; the default web process only keeps the identity sidecars running. Set a start command, or push with `--health-check-type process`", "https://docs.cloudfoundry.org/devguide/deploy-apps/healthchecks.html")
+	}
+
+	return nil
+}
+
+// writeLaunch keeps the launch.yml supply wrote, which knows the steps that
+// ran, and only creates one from the config when supply left none behind.
+func (f *Finalizer) writeLaunch() error {
+	launch := filepath.Join(f.Stager.DepDir(), "launch.yml")
+	if exists, err := libbuildpack.FileExists(launch); err != nil {
+		return err
+	} else if exists {
+		f.Log.Info("Keeping the sidecar processes from supply")
+		return nil
+	}
+
+	if err := f.Supplier.CreateLaunchForSidecars(); err != nil {
+		f.Supplier.Abort()
+		f.Log.Error("Failed to create the sidecar processes; %s", err.Error())
+		return err
+	}
+
+	if err := f.Supplier.Commit(); err != nil {
+		f.Log.Error("Failed to put launch.yml in place; %s", err.Error())
+		return err
+	}
+	return nil
+}
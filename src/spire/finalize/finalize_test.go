@@ -0,0 +1,89 @@
+package finalize
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFinalizeAfterSupply(t *testing.T) {
+	envoy := map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app"}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		skipEnvoy bool
+		wantEnvoy bool
+	}{
+		{
+			name: "agent only",
+		},
+		{
+			name:      "agent and envoy",
+			env:       envoy,
+			wantEnvoy: true,
+		},
+		{
+			name:      "envoy step skipped",
+			env:       envoy,
+			skipEnvoy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.StagingEnv(t, tt.env)
+			if tt.skipEnvoy {
+				t.Setenv("SPIRE_SKIP_STEPS", "envoy")
+			}
+			staging := testutil.NewStaging(t, testutil.Buildpack(t))
+			manifest := staging.Manifest(t)
+
+			// bin/compile runs supply and finalize as separate processes
+			supplier := supply.New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+			if err := supplier.Run(); err != nil {
+				t.Fatalf("supply failed: %v", err)
+			}
+			supplied := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "launch.yml"))
+
+			stager := staging.Stager(manifest)
+			supplier = supply.New(stager, manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+			if err := New(stager, supplier, staging.Log).Run(); err != nil {
+				t.Fatalf("finalize failed: %v", err)
+			}
+
+			launch := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "launch.yml"))
+			if launch != supplied {
+				t.Fatalf("expected finalize to keep the launch.yml from supply\n%s\ngot\n%s", supplied, launch)
+			}
+			if !strings.Contains(launch, `type: "spire_agent"`) {
+				t.Fatalf("expected the spire_agent sidecar, got:\n%s", launch)
+			}
+			if strings.Contains(launch, `type: "app-proxy-envoy"`) != tt.wantEnvoy {
+				t.Fatalf("expected the app-proxy-envoy sidecar: %t, got:\n%s", tt.wantEnvoy, launch)
+			}
+		})
+	}
+}
+
+func TestFinalizeWithoutSupply(t *testing.T) {
+	testutil.StagingEnv(t, map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app"})
+	staging := testutil.NewStaging(t, testutil.Buildpack(t))
+	manifest := staging.Manifest(t)
+	stager := staging.Stager(manifest)
+	supplier := supply.New(stager, manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+
+	if err := New(stager, supplier, staging.Log).Run(); err != nil {
+		t.Fatalf("finalize failed: %v", err)
+	}
+
+	launch := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "launch.yml"))
+	for _, sidecar := range []string{`type: "spire_agent"`, `type: "app-proxy-envoy"`} {
+		if !strings.Contains(launch, sidecar) {
+			t.Fatalf("expected %s from the config, got:\n%s", sidecar, launch)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package finalize
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+const defaultWebCommand = "sleep infinity"
+
+func procfilePath(buildDir string) string {
+	return filepath.Join(buildDir, "Procfile")
+}
+
+func Release(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "---\ndefault_process_types:\n  web: %s\n", defaultWebCommand)
+	return err
+}
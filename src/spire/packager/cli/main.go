@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/packager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	buildpackDir := flag.String("buildpack-dir", ".", "buildpack root directory")
+	cached := flag.Bool("cached", false, "embed the dependencies for the stack so staging needs no network access")
+	stack := flag.String("stack", "cflinuxfs4", "stack to embed dependencies for in a cached buildpack")
+	cnb := flag.Bool("cnb", false, "write the Cloud Native Buildpack directory instead of the CF buildpack zip")
+	out := flag.String("out", "", "zip file or, with -cnb, directory to write; defaults to <language>_buildpack[-cached-<stack>]-v<version>.zip or <language>_cnb[-cached-<stack>]-v<version>")
+	keyFile := flag.String("key", "", "file containing the base64 encoded ed25519 seed to sign the checksum manifest with (required)")
+	flag.Parse()
+
+	os.Exit(run(libbuildpack.NewLogger(os.Stdout), *buildpackDir, *cached, *cnb, *stack, *out, *keyFile))
+}
+
+func run(logger *libbuildpack.Logger, buildpackDir string, cached, cnb bool, stack, out, keyFile string) int {
+	if keyFile == "" {
+		logger.Error("Missing required `-key` flag")
+		flag.Usage()
+		return 2
+	}
+	encoded, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		logger.Error("Unable to read signing key: %s", err.Error())
+		return 2
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		logger.Error("Signing key is not base64 encoded: %s", err.Error())
+		return 2
+	}
+
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		return 10
+	}
+	version, err := manifest.Version()
+	if err != nil {
+		logger.Error("Unable to determine buildpack version: %s", err.Error())
+		return 10
+	}
+	if out == "" && cnb {
+		out = packager.CNBName(manifest.Language(), version, stack, cached)
+	} else if out == "" {
+		out = packager.Name(manifest.Language(), version, stack, cached)
+	}
+	if out, err = filepath.Abs(out); err != nil {
+		logger.Error("Invalid output path: %s", err.Error())
+		return 2
+	}
+
+	logger.BeginStep("Packaging %s buildpack %s", manifest.Language(), version)
+	p := &packager.Packager{
+		BuildpackDir: buildpackDir,
+		Stack:        stack,
+		Cached:       cached,
+		CNB:          cnb,
+		SigningKey:   seed,
+		Log:          logger,
+	}
+	count, err := p.Package(out)
+	if err != nil {
+		logger.Error("Packaging failed: %s", err.Error())
+		return 1
+	}
+	logger.Info("Wrote %s with %d file(s)", out, count)
+	return 0
+}
@@ -0,0 +1,556 @@
+package packager
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PrebuiltDir holds the Go binaries the bin scripts run instead of building
+// them with a downloaded Go toolchain at staging.
+const PrebuiltDir = "bin/prebuilt"
+
+// prebuilt maps every prebuilt binary to the package it is built from.
+var prebuilt = map[string]string{
+	"supply":              "./src/spire/supply/cli",
+	"finalize":            "./src/spire/finalize/cli",
+	"detect":              "./src/spire/detect/cli",
+	"release":             "./src/spire/release/cli",
+	"spire-doctor":        "./src/spire/doctor/cli",
+	"spire-render-config": "./src/spire/runtime/cli",
+}
+
+// CNBDir holds the buildpack.toml of the Cloud Native Buildpack.
+const CNBDir = "cnb"
+
+// cnbMain is the package of the CNB binary. bin/detect and bin/build link to
+// it and it tells the phase from the name it is invoked with.
+var cnbMain = "./src/spire/cnb/cli"
+
+// publicKeyVar is the variable the bin scripts' binaries verify the checksum
+// manifest with, set at build time to match the signing key.
+const publicKeyVar = "github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums.PublicKey"
+
+// manifest holds the manifest.yml fields the packager reads. The packaged
+// manifest.yml is written from the full document, so every other key such as
+// `version_lines` is kept.
+type manifest struct {
+	Dependencies []dependency `yaml:"dependencies"`
+	IncludeFiles []string     `yaml:"include_files"`
+}
+
+type dependency struct {
+	Name     string   `yaml:"name"`
+	Version  string   `yaml:"version"`
+	URI      string   `yaml:"uri"`
+	File     string   `yaml:"file,omitempty"`
+	SHA256   string   `yaml:"sha256"`
+	CFStacks []string `yaml:"cf_stacks"`
+}
+
+type Packager struct {
+	BuildpackDir string
+	Stack        string
+	Cached       bool
+	CNB          bool
+	SigningKey   []byte
+	Log          *libbuildpack.Logger
+}
+
+// Package builds the buildpack zip at out, or the CNB buildpack directory at
+// out when CNB is set, and returns the number of files in it.
+func (p *Packager) Package(out string) (int, error) {
+	publicKey, err := checksums.PublicKeyFromSeed(p.SigningKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var m manifest
+	if err := libbuildpack.NewYAML().Load(filepath.Join(p.BuildpackDir, "manifest.yml"), &m); err != nil {
+		return 0, err
+	}
+	var document map[string]interface{}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(p.BuildpackDir, "manifest.yml"), &document); err != nil {
+		return 0, err
+	}
+
+	if err := checkDependencies(m); err != nil {
+		return 0, err
+	}
+	if err := p.checkIncludeFiles(m); err != nil {
+		return 0, err
+	}
+
+	// a CNB is renamed into place, so it is put together next to out
+	tmpDir := ""
+	if p.CNB {
+		tmpDir = filepath.Dir(out)
+	}
+	dir, err := ioutil.TempDir(tmpDir, ".spire-package")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range m.IncludeFiles {
+		// the CF bin scripts have no use in a CNB, whose bin holds the phases
+		if p.CNB && strings.HasPrefix(filepath.ToSlash(filepath.Clean(file)), "bin/") {
+			continue
+		}
+		if err := libbuildpack.CopyFile(filepath.Join(p.BuildpackDir, file), filepath.Join(dir, file)); err != nil {
+			return 0, err
+		}
+	}
+
+	if p.CNB {
+		err = p.buildCNB(dir, publicKey)
+	} else {
+		err = p.buildBinaries(dir, publicKey)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := p.packageDependencies(dir, m.Dependencies)
+	if err != nil {
+		return 0, err
+	}
+	if err := setDependencyFiles(document, files); err != nil {
+		return 0, err
+	}
+	if err := libbuildpack.NewYAML().Write(filepath.Join(dir, "manifest.yml"), document); err != nil {
+		return 0, err
+	}
+
+	if err := p.sign(dir); err != nil {
+		return 0, err
+	}
+	if _, err := checksums.Verify(dir, publicKey); err != nil {
+		return 0, fmt.Errorf("packaged buildpack fails verification: %s", err.Error())
+	}
+
+	if p.CNB {
+		return writeDir(dir, out)
+	}
+	return writeZip(dir, out, publicKey)
+}
+
+// checkDependencies fails on a dependency whose sha256 is not a SHA-256 hex
+// digest or is all zeros, the placeholder of a digest nobody filled in, so a
+// buildpack never ships an entry no download can match.
+func checkDependencies(m manifest) error {
+	for _, dep := range m.Dependencies {
+		sum, err := hex.DecodeString(dep.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("dependency %s %s: sha256 %q is not a SHA-256 hex digest", dep.Name, dep.Version, dep.SHA256)
+		}
+		if bytes.Equal(sum, make([]byte, sha256.Size)) {
+			return fmt.Errorf("dependency %s %s: sha256 is a placeholder", dep.Name, dep.Version)
+		}
+	}
+	return nil
+}
+
+// checkIncludeFiles fails on listed files that do not exist and on files
+// anywhere under the shipped directories that are not listed. Dependency files
+// are packaged from their manifest entry and the prebuilt binaries are built
+// fresh, so neither needs listing.
+func (p *Packager) checkIncludeFiles(m manifest) error {
+	listed := map[string]bool{}
+	roots := map[string]bool{}
+	var missing []string
+	for _, file := range m.IncludeFiles {
+		file = filepath.Clean(file)
+		listed[file] = true
+		if dir := filepath.Dir(file); dir != "." {
+			roots[strings.Split(filepath.ToSlash(dir), "/")[0]] = true
+		}
+
+		info, err := os.Stat(filepath.Join(p.BuildpackDir, file))
+		if os.IsNotExist(err) {
+			missing = append(missing, file)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("include_files entry `%s` is not a regular file", file)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("include_files lists missing file(s): %s", strings.Join(missing, ", "))
+	}
+
+	for _, dep := range m.Dependencies {
+		if dep.File != "" {
+			listed[filepath.Clean(dep.File)] = true
+		}
+	}
+	for _, path := range checksums.Signed {
+		if path != "manifest.yml" && path != "dependencies" {
+			roots[path] = true
+		}
+	}
+
+	var unlisted []string
+	for root := range roots {
+		err := filepath.Walk(filepath.Join(p.BuildpackDir, root), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			file, err := filepath.Rel(p.BuildpackDir, path)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && file == filepath.FromSlash(PrebuiltDir) {
+				return filepath.SkipDir
+			}
+			if info.Mode().IsRegular() && !listed[file] {
+				unlisted = append(unlisted, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(unlisted) > 0 {
+		sort.Strings(unlisted)
+		return fmt.Errorf("file(s) missing from include_files: %s", strings.Join(unlisted, ", "))
+	}
+	return nil
+}
+
+func (p *Packager) buildBinaries(dir, publicKey string) error {
+	names := make([]string, 0, len(prebuilt))
+	for name := range prebuilt {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := p.build(prebuilt[name], filepath.Join(dir, PrebuiltDir, name), publicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildCNB lays out the CNB root: buildpack.toml, and bin/main with the
+// bin/detect and bin/build phases linking to it.
+func (p *Packager) buildCNB(dir, publicKey string) error {
+	if err := libbuildpack.CopyFile(filepath.Join(p.BuildpackDir, CNBDir, "buildpack.toml"), filepath.Join(dir, "buildpack.toml")); err != nil {
+		return err
+	}
+	if err := p.build(cnbMain, filepath.Join(dir, "bin", "main"), publicKey); err != nil {
+		return err
+	}
+	for _, phase := range []string{"detect", "build"} {
+		if err := os.Symlink("main", filepath.Join(dir, "bin", phase)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Packager) build(pkg, out, publicKey string) error {
+	name := filepath.Base(out)
+	p.Log.Info("Building %s", name)
+	ldflags := fmt.Sprintf("-X %s=%s", publicKeyVar, publicKey)
+	cmd := exec.Command("go", "build", "-mod=vendor", "-ldflags", ldflags, "-o", out, pkg)
+	cmd.Dir = p.BuildpackDir
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH=amd64", "CGO_ENABLED=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("building %s failed: %s\n%s", name, err.Error(), output)
+	}
+	return nil
+}
+
+// packageDependencies puts every dependency for the stack into the zip for a
+// cached buildpack and returns the packaged file of each dependency, empty
+// for the ones downloaded at staging.
+func (p *Packager) packageDependencies(dir string, deps []dependency) ([]string, error) {
+	files := make([]string, len(deps))
+	if !p.Cached {
+		return files, nil
+	}
+
+	for i := range deps {
+		dep := &deps[i]
+		if !supportsStack(dep, p.Stack) {
+			continue
+		}
+
+		file := filepath.Join("dependencies", dep.Name+"-"+dep.Version, filepath.Base(dep.URI))
+		dst := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+
+		if dep.File != "" {
+			if err := libbuildpack.CopyFile(filepath.Join(p.BuildpackDir, dep.File), dst); err != nil {
+				return nil, fmt.Errorf("dependency %s %s: %s", dep.Name, dep.Version, err.Error())
+			}
+		} else if err := p.download(dep.URI, dst); err != nil {
+			return nil, fmt.Errorf("dependency %s %s: %s", dep.Name, dep.Version, err.Error())
+		}
+
+		if err := libbuildpack.CheckSha256(dst, dep.SHA256); err != nil {
+			return nil, fmt.Errorf("dependency %s %s: %s", dep.Name, dep.Version, err.Error())
+		}
+		files[i] = filepath.ToSlash(file)
+	}
+	return files, nil
+}
+
+// setDependencyFiles points the `file` key of every dependency in the
+// manifest document at its packaged file, removing it from the ones that are
+// not packaged. All other keys are left as they are.
+func setDependencyFiles(document map[string]interface{}, files []string) error {
+	deps, _ := document["dependencies"].([]interface{})
+	if len(deps) != len(files) {
+		return fmt.Errorf("manifest.yml has %d dependencies, expected %d", len(deps), len(files))
+	}
+	for i, dep := range deps {
+		entry, ok := dep.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("manifest.yml dependency %d is not a mapping", i+1)
+		}
+		if files[i] == "" {
+			delete(entry, "file")
+		} else {
+			entry["file"] = files[i]
+		}
+	}
+	return nil
+}
+
+func supportsStack(dep *dependency, stack string) bool {
+	for _, s := range dep.CFStacks {
+		if s == stack {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Packager) download(url, dst string) error {
+	p.Log.Info("Downloading %s", url)
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("download of %s failed with status %d", url, resp.StatusCode)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	return err
+}
+
+func (p *Packager) sign(dir string) error {
+	content, err := checksums.Generate(dir)
+	if err != nil {
+		return err
+	}
+	signature, err := checksums.Sign(content, p.SigningKey)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, checksums.ManifestName), content, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, checksums.SignatureName), signature, 0644)
+}
+
+// writeZip zips dir into a temp file next to out and only renames it to out
+// once the files read back from the zip verify against publicKey.
+func writeZip(dir, out, publicKey string) (int, error) {
+	f, err := ioutil.TempFile(filepath.Dir(out), "."+filepath.Base(out)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	count, err := zipDir(dir, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := verifyZip(f.Name(), publicKey); err != nil {
+		return 0, fmt.Errorf("%s fails verification: %s", filepath.Base(out), err.Error())
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return 0, err
+	}
+	return count, os.Rename(f.Name(), out)
+}
+
+// writeDir moves the already verified CNB root at dir to out, which must not
+// exist yet.
+func writeDir(dir, out string) (int, error) {
+	if _, err := os.Lstat(out); err == nil {
+		return 0, fmt.Errorf("`%s` already exists", out)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		return 0, err
+	}
+	return count, os.Rename(dir, out)
+}
+
+func zipDir(dir string, f io.Writer) (int, error) {
+	w := zip.NewWriter(f)
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+		if info.Mode()&0111 != 0 {
+			header.SetMode(0755)
+		} else {
+			header.SetMode(0644)
+		}
+
+		dst, err := w.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(dst, src); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		w.Close()
+		return 0, err
+	}
+	return count, w.Close()
+}
+
+// verifyZip extracts the zip at path and verifies it the way staging does.
+func verifyZip(path, publicKey string) error {
+	dir, err := ioutil.TempDir("", "spire-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unzip(path, dir); err != nil {
+		return err
+	}
+	_, err = checksums.Verify(dir, publicKey)
+	return err
+}
+
+func unzip(path, dir string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		name := filepath.FromSlash(file.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("zip entry `%s` is outside the buildpack", file.Name)
+		}
+		dst := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = createFile(dst, src, file.Mode())
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createFile(path string, content io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CNBName returns the conventional directory name for a CNB version.
+func CNBName(language, version, stack string, cached bool) string {
+	if cached {
+		return fmt.Sprintf("%s_cnb-cached-%s-v%s", language, stack, version)
+	}
+	return fmt.Sprintf("%s_cnb-v%s", language, version)
+}
+
+// Name returns the conventional zip name for a buildpack version.
+func Name(language, version, stack string, cached bool) string {
+	if cached {
+		return fmt.Sprintf("%s_buildpack-cached-%s-v%s.zip", language, stack, version)
+	}
+	return fmt.Sprintf("%s_buildpack-v%s.zip", language, version)
+}
@@ -0,0 +1,291 @@
+package packager
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testManifest = `language: spire-agent
+version_lines:
+  cf_iic:
+    latest: 1.0.x
+default_versions:
+  - name: cf_iic
+    version: 1.0.x
+dependencies:
+  - name: cf_iic
+    version: 1.0.0
+    uri: https://example.com/plugins/cf_iic
+    file: binaries/plugins/cf_iic
+    sha256: %s
+    cf_stacks:
+      - cflinuxfs4
+  - name: svidstore-cf
+    version: 1.0.0
+    uri: https://example.com/plugins/svidstore-cf
+    file: binaries/plugins/svidstore-cf
+    sha256: %s
+    cf_stacks:
+      - cflinuxfs3
+dependency_deprecation_dates: []
+include_files:
+  - VERSION
+  - bin/supply
+  - templates/spire-agent-conf.tmpl
+`
+
+// buildpackDir writes a small buildpack source tree whose only prebuilt
+// binary is a Go module without dependencies.
+func buildpackDir(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"manifest.yml":                    fmt.Sprintf(testManifest, testutil.SHA256Hex("cf_iic"), testutil.SHA256Hex("svidstore-cf")),
+		"VERSION":                         "1.0.0\n",
+		"bin/supply":                      "#!/bin/bash\n",
+		"templates/spire-agent-conf.tmpl": "agent {}\n",
+		"binaries/plugins/cf_iic":         "cf_iic",
+		"binaries/plugins/svidstore-cf":   "svidstore-cf",
+		"go.mod":                          "module example.com/buildpack\n\ngo 1.17\n",
+		"cmd/supply/main.go":              "package main\n\nfunc main() {}\n",
+		"cnb/buildpack.toml":              "api = \"0.7\"\n",
+	} {
+		testutil.WriteFile(t, filepath.Join(root, name), content, 0644)
+	}
+	return root
+}
+
+func extract(t *testing.T, path string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := unzip(path, dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// checkCNB checks a CNB root has its phases linked to bin/main and none of
+// the CF bin scripts.
+func checkCNB(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(dir, "buildpack.toml")); err != nil {
+		t.Fatalf("expected buildpack.toml: %v", err)
+	}
+	for _, phase := range []string{"detect", "build"} {
+		if target, err := os.Readlink(filepath.Join(dir, "bin", phase)); err != nil || target != "main" {
+			t.Fatalf("expected bin/%s to link to main, got %q, %v", phase, target, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "bin", "main")); err != nil || info.Mode()&0111 == 0 {
+		t.Fatalf("expected an executable bin/main, got %v", err)
+	}
+	for _, path := range []string{"bin/supply", PrebuiltDir} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Fatalf("expected no %s in a CNB, got %v", path, err)
+		}
+	}
+}
+
+func TestPackage(t *testing.T) {
+	defer func(original map[string]string, main string) { prebuilt, cnbMain = original, main }(prebuilt, cnbMain)
+	prebuilt = map[string]string{"supply": "./cmd/supply"}
+	cnbMain = "./cmd/supply"
+
+	seed := make([]byte, 32)
+	publicKey, err := checksums.PublicKeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		change    func(t *testing.T, root string)
+		cached    bool
+		cnb       bool
+		seed      []byte
+		wantErr   string
+		wantFiles map[string]string
+	}{
+		{
+			name:      "uncached",
+			wantFiles: map[string]string{"cf_iic": "", "svidstore-cf": ""},
+		},
+		{
+			name:      "cached",
+			cached:    true,
+			wantFiles: map[string]string{"cf_iic": "dependencies/cf_iic-1.0.0/cf_iic", "svidstore-cf": ""},
+		},
+		{
+			name:      "cnb",
+			cnb:       true,
+			cached:    true,
+			wantFiles: map[string]string{"cf_iic": "dependencies/cf_iic-1.0.0/cf_iic", "svidstore-cf": ""},
+		},
+		{
+			name: "missing listed file",
+			change: func(t *testing.T, root string) {
+				if err := os.Remove(filepath.Join(root, "VERSION")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "include_files lists missing file(s): VERSION",
+		},
+		{
+			name: "unlisted file in a nested directory",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "templates/envoy/extra/extra.tmpl"), "extra", 0644)
+			},
+			wantErr: "file(s) missing from include_files: templates/envoy/extra/extra.tmpl",
+		},
+		{
+			name: "unlisted file in an unlisted shipped directory",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "certificates/extra.crt"), "extra", 0644)
+			},
+			wantErr: "file(s) missing from include_files: certificates/extra.crt",
+		},
+		{
+			name: "prebuilt binaries are not listed",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, PrebuiltDir, "supply"), "stale", 0644)
+			},
+			wantFiles: map[string]string{"cf_iic": "", "svidstore-cf": ""},
+		},
+		{
+			name: "cached dependency with the wrong sha256",
+			change: func(t *testing.T, root string) {
+				testutil.WriteFile(t, filepath.Join(root, "binaries/plugins/cf_iic"), "tampered", 0644)
+			},
+			cached:  true,
+			wantErr: "dependency cf_iic 1.0.0",
+		},
+		{
+			name: "placeholder sha256",
+			change: func(t *testing.T, root string) {
+				manifest := testutil.ReadFile(t, filepath.Join(root, "manifest.yml"))
+				manifest = strings.Replace(manifest, testutil.SHA256Hex("cf_iic"), strings.Repeat("0", 64), 1)
+				testutil.WriteFile(t, filepath.Join(root, "manifest.yml"), manifest, 0644)
+			},
+			wantErr: "dependency cf_iic 1.0.0: sha256 is a placeholder",
+		},
+		{
+			name: "invalid sha256",
+			change: func(t *testing.T, root string) {
+				manifest := testutil.ReadFile(t, filepath.Join(root, "manifest.yml"))
+				manifest = strings.Replace(manifest, testutil.SHA256Hex("svidstore-cf"), "TODO", 1)
+				testutil.WriteFile(t, filepath.Join(root, "manifest.yml"), manifest, 0644)
+			},
+			wantErr: `dependency svidstore-cf 1.0.0: sha256 "TODO" is not a SHA-256 hex digest`,
+		},
+		{
+			name:    "short signing key",
+			seed:    []byte("short"),
+			wantErr: "32 byte ed25519 seed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := buildpackDir(t)
+			if tt.change != nil {
+				tt.change(t, root)
+			}
+			key := seed
+			if tt.seed != nil {
+				key = tt.seed
+			}
+			out := filepath.Join(t.TempDir(), "buildpack.zip")
+			if tt.cnb {
+				out = filepath.Join(t.TempDir(), "buildpack")
+			}
+
+			p := &Packager{BuildpackDir: root, Stack: "cflinuxfs4", Cached: tt.cached, CNB: tt.cnb, SigningKey: key, Log: libbuildpack.NewLogger(ioutil.Discard)}
+			count, err := p.Package(out)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				if _, err := os.Stat(out); !os.IsNotExist(err) {
+					t.Fatalf("expected no zip to be written, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			dir := out
+			if tt.cnb {
+				checkCNB(t, dir)
+			} else {
+				r, err := zip.OpenReader(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				if len(r.File) != count {
+					t.Fatalf("expected %d files in the zip, got %d", count, len(r.File))
+				}
+				dir = extract(t, out)
+			}
+			if _, err := checksums.Verify(dir, publicKey); err != nil {
+				t.Fatalf("packaged buildpack does not verify: %v", err)
+			}
+
+			var m struct {
+				VersionLines map[string]map[string]string `yaml:"version_lines"`
+				Dependencies []dependency                 `yaml:"dependencies"`
+			}
+			if err := libbuildpack.NewYAML().Load(filepath.Join(dir, "manifest.yml"), &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.VersionLines["cf_iic"]["latest"] != "1.0.x" {
+				t.Fatalf("expected version_lines to be kept, got %v", m.VersionLines)
+			}
+			for _, dep := range m.Dependencies {
+				if dep.File != tt.wantFiles[dep.Name] {
+					t.Fatalf("expected %s to have file %q, got %q", dep.Name, tt.wantFiles[dep.Name], dep.File)
+				}
+				if dep.File != "" {
+					if _, err := os.Stat(filepath.Join(dir, dep.File)); err != nil {
+						t.Fatalf("expected %s to be packaged: %v", dep.Name, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyZipRejectsModifiedPackage(t *testing.T) {
+	seed := make([]byte, 32)
+	publicKey, err := checksums.PublicKeyFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "manifest.yml"), "language: spire-agent\n", 0644)
+	testutil.WriteFile(t, filepath.Join(dir, "bin/supply"), "#!/bin/bash\n", 0644)
+	p := &Packager{SigningKey: seed}
+	if err := p.sign(dir); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(dir, "bin/supply"), "tampered", 0644)
+
+	out := filepath.Join(t.TempDir(), "buildpack.zip")
+	if _, err := writeZip(dir, out, publicKey); err == nil || !strings.Contains(err.Error(), "bin/supply") {
+		t.Fatalf("expected the modified file to fail verification, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected no zip to be written, got %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/finalize"
+	"os"
+)
+
+func main() {
+	if err := finalize.Release(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write release: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
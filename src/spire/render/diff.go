@@ -0,0 +1,142 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func Diff(previousDir, currentDir string, w io.Writer) (bool, error) {
+	previous, err := listFiles(previousDir)
+	if err != nil {
+		return false, err
+	}
+	current, err := listFiles(currentDir)
+	if err != nil {
+		return false, err
+	}
+
+	names := map[string]bool{}
+	for name := range previous {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	changed := false
+	for _, name := range sorted {
+		var before, after []byte
+		if previous[name] {
+			if before, err = ioutil.ReadFile(filepath.Join(previousDir, name)); err != nil {
+				return false, err
+			}
+		}
+		if current[name] {
+			if after, err = ioutil.ReadFile(filepath.Join(currentDir, name)); err != nil {
+				return false, err
+			}
+		}
+		if previous[name] && current[name] && bytes.Equal(before, after) {
+			continue
+		}
+
+		changed = true
+		switch {
+		case !previous[name]:
+			fmt.Fprintf(w, "+++ %s (added)\n", name)
+		case !current[name]:
+			fmt.Fprintf(w, "--- %s (removed)\n", name)
+		default:
+			fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", name, name)
+		}
+		for _, line := range DiffLines(splitLines(before), splitLines(after)) {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	return changed, nil
+}
+
+// DiffLines returns the changed lines between before and after, prefixed with
+// `-` or `+`, based on their longest common subsequence.
+func DiffLines(before, after []string) []string {
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		switch {
+		case before[i] == after[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+before[i])
+			i++
+		default:
+			lines = append(lines, "+"+after[j])
+			j++
+		}
+	}
+	for ; i < len(before); i++ {
+		lines = append(lines, "-"+before[i])
+	}
+	for ; j < len(after); j++ {
+		lines = append(lines, "+"+after[j])
+	}
+
+	return lines
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func listFiles(dir string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
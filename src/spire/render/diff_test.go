@@ -0,0 +1,94 @@
+package render_test
+
+import (
+	"bytes"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/render"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// renderInto renders the configuration of the buildpack at buildpackDir into
+// a new out dir the way `supply render -out` does.
+func renderInto(t *testing.T, buildpackDir string) string {
+	t.Helper()
+	outDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outDir, "0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := libbuildpack.NewLogger(ioutil.Discard)
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	supplier := supply.New(render.NewStager(outDir, "0", t.TempDir()), manifest, libbuildpack.NewInstaller(manifest), logger, &libbuildpack.Command{})
+	supplier.Local = true
+	if err := supplier.Render(); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	return outDir
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantChanged bool
+		want        []string
+	}{
+		{
+			name: "unchanged env",
+		},
+		{
+			name:        "changed server address",
+			env:         map[string]string{"SPIRE_SERVER_ADDRESS": "other-server.example.org"},
+			wantChanged: true,
+			want: []string{
+				"--- a/0/spire-agent.conf\n+++ b/0/spire-agent.conf\n",
+				`-  server_address    = "spire-server.example.org"`,
+				`+  server_address    = "other-server.example.org"`,
+			},
+		},
+		{
+			name:        "envoy enabled",
+			env:         map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app"},
+			wantChanged: true,
+			want:        []string{"+++ 0/envoy-config.yaml (added)\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.StagingEnv(t, nil)
+			buildpackDir := testutil.Buildpack(t)
+			previousDir := renderInto(t, buildpackDir)
+
+			testutil.StagingEnv(t, tt.env)
+			currentDir := renderInto(t, buildpackDir)
+
+			var out bytes.Buffer
+			changed, err := render.Diff(previousDir, currentDir, &out)
+			if err != nil {
+				t.Fatalf("diff failed: %v", err)
+			}
+			if changed != tt.wantChanged {
+				t.Fatalf("expected changed %t, got %t with output:\n%s", tt.wantChanged, changed, out.String())
+			}
+			if !tt.wantChanged && out.Len() != 0 {
+				t.Fatalf("expected no output, got:\n%s", out.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Fatalf("expected %q in the diff, got:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
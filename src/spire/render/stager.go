@@ -0,0 +1,66 @@
+package render
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type Stager struct {
+	depsDir  string
+	depsIdx  string
+	buildDir string
+}
+
+func NewStager(depsDir, depsIdx, buildDir string) *Stager {
+	return &Stager{
+		depsDir:  depsDir,
+		depsIdx:  depsIdx,
+		buildDir: buildDir,
+	}
+}
+
+func (s *Stager) AddBinDependencyLink(destPath, sourceName string) error {
+	binDir := filepath.Join(s.DepDir(), "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return err
+	}
+
+	relPath, err := filepath.Rel(binDir, destPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(relPath, filepath.Join(binDir, sourceName))
+}
+
+func (s *Stager) DepDir() string {
+	return filepath.Join(s.depsDir, s.depsIdx)
+}
+
+func (s *Stager) DepsIdx() string {
+	return s.depsIdx
+}
+
+func (s *Stager) DepsDir() string {
+	return s.depsDir
+}
+
+func (s *Stager) BuildDir() string {
+	return s.buildDir
+}
+
+func (s *Stager) WriteProfileD(scriptName, scriptContents string) error {
+	profileDir := filepath.Join(s.DepDir(), "profile.d")
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(profileDir, scriptName), []byte(scriptContents), 0755)
+}
+
+func (s *Stager) WriteConfigYml(config interface{}) error {
+	data := map[string]interface{}{"name": "spire-agent", "config": config}
+	return libbuildpack.NewYAML().Write(filepath.Join(s.DepDir(), "config.yml"), data)
+}
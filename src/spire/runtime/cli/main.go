@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/runtime"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(supply.NewRedactingWriter(os.Stderr))
+
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("Unable to determine deps directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	r := &runtime.Renderer{
+		DepDir: filepath.Dir(filepath.Dir(executable)),
+		AppDir: utils.EnvWithDefault("HOME", "/home/vcap/app"),
+		Log:    logger,
+	}
+	os.Exit(r.Run())
+}
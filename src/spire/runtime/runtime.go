@@ -0,0 +1,84 @@
+// Package runtime renders the agent and Envoy configs again at container
+// start, from the runtime environment and the templates staging installed.
+package runtime
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/render"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var renderedFiles = []string{"spire-agent.conf", "envoy-config.yaml"}
+
+type Renderer struct {
+	DepDir string
+	AppDir string
+	Log    *libbuildpack.Logger
+}
+
+// Run renders the configs into DepDir and returns the exit code of the
+// renderer. The configs from staging are only replaced once every config
+// rendered.
+func (r *Renderer) Run() int {
+	depsIdx := filepath.Base(r.DepDir)
+
+	manifest, err := libbuildpack.NewManifest(r.DepDir, r.Log, time.Now())
+	if err != nil {
+		r.Log.Error("Unable to load buildpack manifest: %s", err.Error())
+		return 10
+	}
+
+	// render into a scratch deps dir first, every process of the app sources
+	// profile.d and must never see a partially written config
+	tmpDepsDir, err := ioutil.TempDir(r.DepDir, ".render")
+	if err != nil {
+		r.Log.Error("Unable to create render directory: %s", err.Error())
+		return 12
+	}
+	defer os.RemoveAll(tmpDepsDir)
+
+	stager := render.NewStager(tmpDepsDir, depsIdx, r.AppDir)
+	if err := os.MkdirAll(stager.DepDir(), 0755); err != nil {
+		r.Log.Error("Unable to create render directory: %s", err.Error())
+		return 12
+	}
+
+	supplier := supply.New(stager, manifest, libbuildpack.NewInstaller(manifest), r.Log, &libbuildpack.Command{})
+	supplier.RuntimeDepsDir = filepath.Dir(r.DepDir)
+	if err := supplier.LoadConfig(); err != nil {
+		r.Log.Error("Unable to load buildpack.yml; %s", err.Error())
+		return supply.ExitCode(err)
+	}
+	if err := supplier.LoadInstalledPlugins(filepath.Join(r.DepDir, "bin")); err != nil {
+		r.Log.Error("Unable to inspect installed plugins; %s", err.Error())
+		return supply.ExitCode(err)
+	}
+	if err := supplier.RenderRuntimeConfigs(); err != nil {
+		supplier.Abort()
+		return supply.ExitCode(err)
+	}
+	if err := supplier.Commit(); err != nil {
+		r.Log.Error("Unable to put rendered configs in place: %s", err.Error())
+		return 15
+	}
+
+	for _, name := range renderedFiles {
+		src := filepath.Join(stager.DepDir(), name)
+		if exists, err := libbuildpack.FileExists(src); err != nil {
+			r.Log.Error("Unable to read rendered %s: %s", name, err.Error())
+			return 15
+		} else if !exists {
+			continue
+		}
+		if err := os.Rename(src, filepath.Join(r.DepDir, name)); err != nil {
+			r.Log.Error("Unable to install rendered %s: %s", name, err.Error())
+			return 15
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,105 @@
+package runtime
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stage runs supply with the runtime renderer enabled and returns the
+// staging.
+func stage(t *testing.T) *testutil.Staging {
+	t.Helper()
+	testutil.StagingEnv(t, map[string]string{
+		"SPIRE_RUNTIME_RENDER":        "true",
+		"SPIRE_ENVOY_PROXY":           "true",
+		"SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app",
+	})
+	staging := testutil.NewStaging(t, testutil.Buildpack(t))
+	manifest := staging.Manifest(t)
+	s := supply.New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+	if err := s.Run(); err != nil {
+		t.Fatalf("staging failed: %v", err)
+	}
+	return staging
+}
+
+func TestRenderer(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantCode     int
+		wantRendered map[string]string
+	}{
+		{
+			name: "runtime values",
+			env:  map[string]string{"SPIRE_SERVER_ADDRESS": "other-server.example.org", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/other"},
+			wantRendered: map[string]string{
+				"spire-agent.conf":  `server_address    = "other-server.example.org"`,
+				"envoy-config.yaml": `- name: "spiffe://example.org/other"`,
+			},
+		},
+		{
+			name:     "missing trust domain",
+			env:      map[string]string{"SPIRE_SERVER_ADDRESS": "other-server.example.org", "SPIRE_TRUST_DOMAIN": ""},
+			wantCode: supply.MissingConfiguration.ExitCode(),
+		},
+		{
+			name:     "invalid server port",
+			env:      map[string]string{"SPIRE_SERVER_PORT": "not a port"},
+			wantCode: supply.InvalidConfiguration.ExitCode(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staging := stage(t)
+			staged := map[string]string{}
+			for _, name := range renderedFiles {
+				staged[name] = testutil.ReadFile(t, filepath.Join(staging.DepDir(), name))
+			}
+
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			r := &Renderer{DepDir: staging.DepDir(), AppDir: staging.BuildDir, Log: libbuildpack.NewLogger(ioutil.Discard)}
+			if code := r.Run(); code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got %d", tt.wantCode, code)
+			}
+
+			for _, name := range renderedFiles {
+				content := testutil.ReadFile(t, filepath.Join(staging.DepDir(), name))
+				if tt.wantCode != 0 {
+					if content != staged[name] {
+						t.Errorf("expected a failed render to keep the staged %s\n%s\ngot\n%s", name, staged[name], content)
+					}
+					continue
+				}
+				if !strings.Contains(content, tt.wantRendered[name]) {
+					t.Errorf("expected %q in the rendered %s, got:\n%s", tt.wantRendered[name], name, content)
+				}
+				if !strings.Contains(content, staging.DepDir()) {
+					t.Errorf("expected the rendered %s to point into %s, got:\n%s", name, staging.DepDir(), content)
+				}
+			}
+
+			files, err := ioutil.ReadDir(staging.DepDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if strings.HasPrefix(f.Name(), ".render") {
+					t.Errorf("expected the render directory to be removed, found %s", f.Name())
+				}
+			}
+			if _, err := os.Stat(filepath.Join(staging.DepDir(), "templates", "spire-agent-conf.tmpl")); err != nil {
+				t.Errorf("expected the staged templates to be kept: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package supply
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"math/big"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	pemBundleFormat    = "pem"
+	spiffeBundleFormat = "spiffe"
+
+	spiffeBundleName = "bundle.json"
+)
+
+type spiffeBundle struct {
+	Keys []spiffeBundleKey `json:"keys"`
+}
+
+type spiffeBundleKey struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+// trustBundleFormat returns the format the agent reads its bootstrap bundle
+// in, or an empty string when the operator left the choice to the source.
+func trustBundleFormat() (string, error) {
+	format := strings.ToLower(utils.EnvWithDefault(spireTrustBundleFormatEnv, ""))
+	switch format {
+	case "", pemBundleFormat, spiffeBundleFormat:
+		return format, nil
+	default:
+		return "", invalidConfigError("unsupported `%s` value `%s`; expected `%s` or `%s`", spireTrustBundleFormatEnv, format, pemBundleFormat, spiffeBundleFormat)
+	}
+}
+
+// detectBundleFormat tells a SPIFFE bundle, which is a JSON document, from
+// PEM encoded certificates.
+func detectBundleFormat(content []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return spiffeBundleFormat
+	}
+	return pemBundleFormat
+}
+
+// parseSpiffeBundle returns the X.509 authorities of a SPIFFE bundle, which
+// is a JWK set whose `x509-svid` keys carry the CA certificate in `x5c`.
+func parseSpiffeBundle(content []byte) ([]*x509.Certificate, error) {
+	var bundle spiffeBundle
+	if err := json.Unmarshal(content, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid SPIFFE bundle: %s", err.Error())
+	}
+
+	var certs []*x509.Certificate
+	for _, key := range bundle.Keys {
+		if key.Use != "x509-svid" {
+			continue
+		}
+		if len(key.X5c) != 1 {
+			return nil, fmt.Errorf("invalid SPIFFE bundle: x509-svid key must contain exactly one certificate, found %d", len(key.X5c))
+		}
+		der, err := base64.StdEncoding.DecodeString(key.X5c[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE bundle: %s", err.Error())
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPIFFE bundle: %s", err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("SPIFFE bundle contains no x509-svid keys")
+	}
+	return certs, nil
+}
+
+// encodeSpiffeBundle converts certificates into a SPIFFE bundle with one
+// `x509-svid` key per authority.
+func encodeSpiffeBundle(certs []*x509.Certificate) ([]byte, error) {
+	bundle := spiffeBundle{Keys: []spiffeBundleKey{}}
+	for _, cert := range certs {
+		key := spiffeBundleKey{Use: "x509-svid", X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)}}
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			key.Kty = "RSA"
+			key.N = base64URL(pub.N.Bytes())
+			key.E = base64URL(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			key.Kty = "EC"
+			key.Crv = pub.Curve.Params().Name
+			key.X = base64URL(pad(pub.X.Bytes(), size))
+			key.Y = base64URL(pad(pub.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			key.Kty = "OKP"
+			key.Crv = "Ed25519"
+			key.X = base64URL(pub)
+		default:
+			return nil, fmt.Errorf("certificate `%s` has an unsupported public key type %T", cert.Subject, pub)
+		}
+		bundle.Keys = append(bundle.Keys, key)
+	}
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func parseBundle(content []byte, format string) ([]*x509.Certificate, error) {
+	switch strings.ToLower(format) {
+	case pemBundleFormat:
+		return parseCertificates(content, false)
+	case spiffeBundleFormat:
+		return parseSpiffeBundle(content)
+	default:
+		return nil, fmt.Errorf("unsupported trust bundle format `%s`; expected `%s` or `%s`", format, pemBundleFormat, spiffeBundleFormat)
+	}
+}
+
+// trustBundleData points the agent at the bootstrap bundle: the verified URL
+// when there is one, otherwise the installed file in the format it was
+// installed in.
+func (s *Supplier) trustBundleData(data map[string]interface{}) error {
+	if s.TrustBundleURL != nil {
+		data["TrustBundleURL"] = s.TrustBundleURL.URL
+		data["TrustBundleFormat"] = s.TrustBundleURL.Format
+		return nil
+	}
+
+	format, err := trustBundleFormat()
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		// the runtime renderer stages into a scratch dir, the bundle installed
+		// at staging lives in the runtime deps dir
+		for _, dir := range []string{s.Stager.DepDir(), s.RuntimeDepDir()} {
+			if s.pendingPath(filepath.Join(dir, "certificates", spiffeBundleName)) != "" {
+				format = spiffeBundleFormat
+				break
+			}
+		}
+	}
+
+	if format == spiffeBundleFormat {
+		data["TrustBundlePath"] = filepath.Join(s.RuntimeDepDir(), "certificates", spiffeBundleName)
+		data["TrustBundleFormat"] = spiffeBundleFormat
+	} else {
+		data["TrustBundlePath"] = s.pemTrustBundlePath()
+	}
+	return nil
+}
+
+// pemTrustBundlePath is the PEM copy of the trust bundle that InstallTrustBundle
+// writes for every source format.
+func (s *Supplier) pemTrustBundlePath() string {
+	return filepath.Join(s.RuntimeDepDir(), "certificates", trustBundleName)
+}
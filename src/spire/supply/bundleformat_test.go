@@ -0,0 +1,60 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvoyTrustedCA(t *testing.T) {
+	bundle := testCA(t)
+	certs, err := parseCertificates(bundle, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := encodeSpiffeBundle(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		bundle     []byte
+		wantSpiffe bool
+	}{
+		{name: "PEM bundle", bundle: bundle},
+		{name: "SPIFFE bundle", bundle: jwks, wantSpiffe: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.StagingEnv(t, map[string]string{
+				"SPIRE_TRUST_BUNDLE":          string(tt.bundle),
+				"SPIRE_ENVOY_PROXY":           "true",
+				"SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app",
+			})
+			staging := testutil.NewStaging(t, testutil.Buildpack(t))
+			manifest := staging.Manifest(t)
+			s := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+			if err := s.Run(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			trustedCA := filepath.Join(s.RuntimeDepDir(), "certificates", trustBundleName)
+			envoyConfig := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "envoy-config.yaml"))
+			if !strings.Contains(envoyConfig, "trusted_ca:\n              filename: \""+trustedCA+"\"") {
+				t.Fatalf("expected Envoy to trust %s, got:\n%s", trustedCA, envoyConfig)
+			}
+			if pem := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "certificates", trustBundleName)); pem != string(bundle) {
+				t.Fatalf("expected the PEM trust bundle\n%s\ngot\n%s", bundle, pem)
+			}
+			_, err := os.Stat(filepath.Join(staging.DepDir(), "certificates", spiffeBundleName))
+			if tt.wantSpiffe != (err == nil) {
+				t.Fatalf("expected the SPIFFE bundle for the agent: %t, got %v", tt.wantSpiffe, err)
+			}
+		})
+	}
+}
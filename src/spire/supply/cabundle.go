@@ -0,0 +1,129 @@
+package supply
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	spireSystemCABundleEnv = "SPIRE_SYSTEM_CA_BUNDLE"
+	spireSystemCAFileEnv   = "SPIRE_SYSTEM_CA_FILE"
+
+	defaultSystemCAFile = "/etc/ssl/certs/ca-certificates.crt"
+	caBundleName        = "ca-bundle.crt"
+)
+
+// caBundleEnvVars are the variables common TLS stacks (OpenSSL, Python
+// requests, curl, git and Node.js) read their extra or replacement roots from.
+var caBundleEnvVars = []string{
+	"SSL_CERT_FILE",
+	"REQUESTS_CA_BUNDLE",
+	"CURL_CA_BUNDLE",
+	"GIT_SSL_CAINFO",
+	"NODE_EXTRA_CA_CERTS",
+}
+
+func caBundleEnabled() bool {
+	return strings.ToLower(utils.EnvWithDefault(spireSystemCABundleEnv, "false")) == "true"
+}
+
+func (s *Supplier) caBundlePath() string {
+	return filepath.Join(s.RuntimeDepDir(), "certificates", caBundleName)
+}
+
+// WriteCABundle combines the stack's system roots with the SPIRE certificates
+// installed in the deps dir so apps can reach SPIFFE-authenticated services
+// directly over TLS.
+func (s *Supplier) WriteCABundle() error {
+	if !caBundleEnabled() {
+		return nil
+	}
+
+	systemFile := utils.EnvWithDefault(spireSystemCAFileEnv, defaultSystemCAFile)
+	if exists, err := libbuildpack.FileExists(systemFile); err != nil {
+		return err
+	} else if !exists {
+		return missingConfigError("system CA file `%s` does not exist on this stack; set `%s` to the stack's CA bundle", systemFile, spireSystemCAFileEnv)
+	}
+	system, err := ioutil.ReadFile(systemFile)
+	if err != nil {
+		return err
+	}
+
+	certs, err := s.installedCertificates()
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	out.Write(bytes.TrimRight(system, "\n"))
+	out.WriteString("\n")
+	out.Write(encodeCertificates(certs))
+
+	if err := s.writeGenerated(filepath.Join(s.Stager.DepDir(), "certificates", caBundleName), out.Bytes(), certificateMode); err != nil {
+		return err
+	}
+	s.Log.Info("Combined CA bundle includes %s and %d SPIRE certificate(s)", systemFile, len(certs))
+
+	var script strings.Builder
+	for _, name := range caBundleEnvVars {
+		script.WriteString(fmt.Sprintf("export %s=%s\n", name, s.caBundlePath()))
+	}
+	return s.writeProfileD("spire-ca-bundle.sh", script.String())
+}
+
+// installedCertificates returns the valid certificates installed in the deps
+// dir. Expired and not yet valid ones are left out of the bundle.
+func (s *Supplier) installedCertificates() ([]*x509.Certificate, error) {
+	// certificates installed by this staging are still in temp files
+	files, err := s.certificateFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var certs []*x509.Certificate
+	seen := map[string]bool{}
+	for _, name := range utils.SortedKeys(files) {
+		if name == caBundleName {
+			continue
+		}
+		content, err := ioutil.ReadFile(files[name])
+		if err != nil {
+			return nil, err
+		}
+		// SPIFFE bundles are installed next to their PEM copy
+		if detectBundleFormat(content) == spiffeBundleFormat {
+			continue
+		}
+		parsed, err := parseCertificates(content, true)
+		if err != nil {
+			return nil, fmt.Errorf("can't add `%s` to the CA bundle: %s", name, err.Error())
+		}
+		for _, cert := range parsed {
+			switch {
+			case now.After(cert.NotAfter):
+				s.Log.Warning("Leaving certificate `%s` from `%s` out of the CA bundle; it expired at %s", cert.Subject, name, cert.NotAfter.Format(time.RFC3339))
+				continue
+			case now.Before(cert.NotBefore):
+				s.Log.Warning("Leaving certificate `%s` from `%s` out of the CA bundle; it is not valid before %s", cert.Subject, name, cert.NotBefore.Format(time.RFC3339))
+				continue
+			case seen[string(cert.Raw)]:
+				continue
+			}
+			seen[string(cert.Raw)] = true
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, missingConfigError("no valid SPIRE certificates are installed to add to the CA bundle")
+	}
+	return certs, nil
+}
@@ -0,0 +1,137 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const appCacheSubDir = "spire-agent"
+
+// AppCacheInstaller is an Installer that keeps an app cache between stagings.
+type AppCacheInstaller interface {
+	Installer
+	CleanupAppCache() error
+}
+
+// fileInstaller is implemented by installers that can reuse a local file
+// from the app cache.
+type fileInstaller interface {
+	InstallFile(src, dst string) error
+}
+
+// CachingInstaller stores installed binaries and plugins in the app cache dir
+// under their SHA-256 so a restage reuses them. Entries not used by the
+// current staging are evicted by CleanupAppCache.
+type CachingInstaller struct {
+	AppCacheInstaller
+	manifest Manifest
+	dir      string
+	used     map[string]bool
+	log      *libbuildpack.Logger
+}
+
+func NewCachingInstaller(installer AppCacheInstaller, manifest Manifest, cacheDir string, logger *libbuildpack.Logger) *CachingInstaller {
+	return &CachingInstaller{
+		AppCacheInstaller: installer,
+		manifest:          manifest,
+		dir:               filepath.Join(cacheDir, appCacheSubDir),
+		used:              map[string]bool{},
+		log:               logger,
+	}
+}
+
+func (c *CachingInstaller) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	entry, err := c.manifest.GetEntry(dep)
+	if err != nil {
+		return err
+	}
+
+	// archives are extracted into outputDir, only single files are cached
+	name := filepath.Base(entry.URI)
+	for _, ext := range []string{".zip", ".tar.xz", ".tar.gz", ".tgz", ".sh"} {
+		if strings.HasSuffix(name, ext) {
+			return c.AppCacheInstaller.InstallDependency(dep, outputDir)
+		}
+	}
+
+	dst := filepath.Join(outputDir, name)
+	if ok, err := c.restore(entry.SHA256, name, dst); err != nil || ok {
+		return err
+	}
+
+	if err := c.AppCacheInstaller.InstallDependency(dep, outputDir); err != nil {
+		return err
+	}
+	return c.store(entry.SHA256, name, dst)
+}
+
+// InstallFile copies a file shipped in the buildpack to dst, reusing the
+// cached copy when its content is unchanged.
+func (c *CachingInstaller) InstallFile(src, dst string) error {
+	sum, err := checksums.SHA256File(src)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(src)
+	if ok, err := c.restore(sum, name, dst); err != nil || ok {
+		return err
+	}
+
+	if err := libbuildpack.CopyFile(src, dst); err != nil {
+		return err
+	}
+	return c.store(sum, name, dst)
+}
+
+func (c *CachingInstaller) CleanupAppCache() error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if c.used[entry.Name()] {
+			continue
+		}
+		c.log.Debug("Evicting cached asset %s", entry.Name())
+		if err := os.RemoveAll(filepath.Join(c.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return c.AppCacheInstaller.CleanupAppCache()
+}
+
+func (c *CachingInstaller) restore(sum, name, dst string) (bool, error) {
+	if sum == "" {
+		return false, nil
+	}
+	cached := filepath.Join(c.dir, sum, name)
+	if exists, err := libbuildpack.FileExists(cached); err != nil || !exists {
+		return false, err
+	}
+
+	if err := libbuildpack.CheckSha256(cached, sum); err != nil {
+		c.log.Warning("Ignoring corrupt cached %s: %s", name, err.Error())
+		return false, os.RemoveAll(filepath.Dir(cached))
+	}
+
+	c.log.Info("Reusing cached %s", name)
+	c.used[sum] = true
+	return true, libbuildpack.CopyFile(cached, dst)
+}
+
+func (c *CachingInstaller) store(sum, name, src string) error {
+	if sum == "" {
+		return nil
+	}
+	c.used[sum] = true
+	if err := libbuildpack.CopyFile(src, filepath.Join(c.dir, sum, name)); err != nil {
+		c.log.Warning("Unable to cache %s: %s", name, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingInstaller installs the testutil plugins and counts the installs
+// and app cache cleanups it was asked for.
+type countingInstaller struct {
+	installs map[string]int
+	cleanups int
+}
+
+func (i *countingInstaller) InstallDependency(dep libbuildpack.Dependency, outputDir string) error {
+	i.installs[dep.Name]++
+	return ioutil.WriteFile(filepath.Join(outputDir, dep.Name), []byte(testutil.Plugins[dep.Name]), 0755)
+}
+
+func (i *countingInstaller) InstallOnlyVersion(string, string) error {
+	return nil
+}
+
+func (i *countingInstaller) CleanupAppCache() error {
+	i.cleanups++
+	return nil
+}
+
+func TestCachingInstaller(t *testing.T) {
+	testutil.StagingEnv(t, nil)
+	staging := testutil.NewStaging(t, testutil.Buildpack(t))
+	manifest := staging.Manifest(t)
+	cacheDir := filepath.Join(staging.CacheDir, appCacheSubDir)
+	cfIic := libbuildpack.Dependency{Name: cfIicPlugin, Version: "1.0.0"}
+	svidStore := libbuildpack.Dependency{Name: svidStoreCfPlugin, Version: "1.0.0"}
+
+	cached := func(name string) string {
+		return filepath.Join(cacheDir, testutil.SHA256Hex(testutil.Plugins[name]), name)
+	}
+
+	// stageWith installs deps the way a staging does, with a new installer
+	// on the same cache dir, and checks each one was installed
+	stageWith := func(t *testing.T, deps ...libbuildpack.Dependency) *countingInstaller {
+		t.Helper()
+		underlying := &countingInstaller{installs: map[string]int{}}
+		c := NewCachingInstaller(underlying, manifest, staging.CacheDir, staging.Log)
+		outputDir := t.TempDir()
+		for _, dep := range deps {
+			if err := c.InstallDependency(dep, outputDir); err != nil {
+				t.Fatal(err)
+			}
+			if content := testutil.ReadFile(t, filepath.Join(outputDir, dep.Name)); content != testutil.Plugins[dep.Name] {
+				t.Fatalf("expected the installed %s to be %q, got %q", dep.Name, testutil.Plugins[dep.Name], content)
+			}
+		}
+		if err := c.CleanupAppCache(); err != nil {
+			t.Fatal(err)
+		}
+		if underlying.cleanups != 1 {
+			t.Fatalf("expected the app cache cleanup to reach the installer once, got %d", underlying.cleanups)
+		}
+		return underlying
+	}
+
+	t.Run("first staging caches every plugin", func(t *testing.T) {
+		underlying := stageWith(t, cfIic, svidStore)
+		if underlying.installs[cfIicPlugin] != 1 || underlying.installs[svidStoreCfPlugin] != 1 {
+			t.Fatalf("expected each plugin to be installed once, got %v", underlying.installs)
+		}
+		for _, name := range spirePlugins {
+			if _, err := os.Stat(cached(name)); err != nil {
+				t.Fatalf("expected %s in the app cache: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("restage reuses the cached plugins", func(t *testing.T) {
+		underlying := stageWith(t, cfIic, svidStore)
+		if len(underlying.installs) != 0 {
+			t.Fatalf("expected the cached plugins to be reused, got installs %v", underlying.installs)
+		}
+	})
+
+	t.Run("corrupt cached plugin is installed again", func(t *testing.T) {
+		testutil.WriteFile(t, cached(cfIicPlugin), "corrupt", 0755)
+		underlying := stageWith(t, cfIic, svidStore)
+		if underlying.installs[cfIicPlugin] != 1 || underlying.installs[svidStoreCfPlugin] != 0 {
+			t.Fatalf("expected only the corrupt plugin to be installed again, got %v", underlying.installs)
+		}
+		if content := testutil.ReadFile(t, cached(cfIicPlugin)); content != testutil.Plugins[cfIicPlugin] {
+			t.Fatalf("expected the app cache to hold the reinstalled plugin, got %q", content)
+		}
+	})
+
+	t.Run("unused entries are evicted", func(t *testing.T) {
+		stale := filepath.Join(cacheDir, testutil.SHA256Hex("old plugin"), cfIicPlugin)
+		testutil.WriteFile(t, stale, "old plugin", 0755)
+
+		stageWith(t, cfIic)
+
+		for path, wantKept := range map[string]bool{cached(cfIicPlugin): true, cached(svidStoreCfPlugin): false, stale: false} {
+			_, err := os.Stat(path)
+			if wantKept && err != nil {
+				t.Errorf("expected %s to be kept: %v", path, err)
+			} else if !wantKept && !os.IsNotExist(err) {
+				t.Errorf("expected %s to be evicted, got %v", path, err)
+			}
+		}
+	})
+}
+
+func TestCachingInstallerInstallFile(t *testing.T) {
+	cacheDir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "spire-agent")
+	testutil.WriteFile(t, src, "spire-agent 1.9.0", 0755)
+
+	// install stages src with a new installer on the same cache dir and
+	// checks the installed copy
+	install := func(t *testing.T, want string) *CachingInstaller {
+		t.Helper()
+		c := NewCachingInstaller(&countingInstaller{installs: map[string]int{}}, nil, cacheDir, libbuildpack.NewLogger(ioutil.Discard))
+		dst := filepath.Join(t.TempDir(), "spire-agent")
+		if err := c.InstallFile(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		if content := testutil.ReadFile(t, dst); content != want {
+			t.Fatalf("expected the installed file to be %q, got %q", want, content)
+		}
+		return c
+	}
+
+	install(t, "spire-agent 1.9.0")
+	cached := filepath.Join(cacheDir, appCacheSubDir, testutil.SHA256Hex("spire-agent 1.9.0"), "spire-agent")
+	if _, err := os.Stat(cached); err != nil {
+		t.Fatalf("expected the file in the app cache: %v", err)
+	}
+
+	// a changed source replaces the cached copy on the next staging
+	testutil.WriteFile(t, src, "spire-agent 1.10.0", 0755)
+	c := install(t, "spire-agent 1.10.0")
+	if err := c.CleanupAppCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Fatalf("expected the cached copy of the old source to be evicted, got %v", err)
+	}
+}
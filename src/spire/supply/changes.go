@@ -0,0 +1,243 @@
+package supply
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	previousConfigsDir = "spire-agent-configs"
+	stagingResultName  = "staging-result.yml"
+)
+
+// reportedConfigs are the generated files compared with the previous staging.
+var reportedConfigs = []string{"spire-agent.conf", "envoy-config.yaml", "launch.yml"}
+
+// secretKeyParts mark settings whose values are never printed in the report.
+var secretKeyParts = []string{"token", "password", "secret"}
+
+type cacheDirStager interface {
+	CacheDir() string
+}
+
+// ReportChanges prints what the generated configs change compared with the
+// previous staging and keeps them in the app cache dir for the next one.
+func (s *Supplier) ReportChanges() error {
+	stager, ok := s.Stager.(cacheDirStager)
+	if !ok {
+		return nil
+	}
+	previousDir := filepath.Join(stager.CacheDir(), previousConfigsDir)
+
+	// the staging result leads the report with the SPIFFE ID, plugin
+	// versions and the sidecars that are enabled
+	result := filepath.Join(previousDir, stagingResultName)
+	f, err := s.createGenerated(result, configMode)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := libbuildpack.NewYAML().Write(f.Name(), s.StagingResult()); err != nil {
+		return err
+	}
+
+	firstStaging := true
+	report, hadPrevious, err := s.configChanges(stagingResultName, result, f.Name())
+	if err != nil {
+		return err
+	}
+	if hadPrevious {
+		firstStaging = false
+	}
+
+	for _, name := range reportedConfigs {
+		previous := filepath.Join(previousDir, name)
+		current := filepath.Join(s.Stager.DepDir(), name)
+
+		lines, hadPrevious, err := s.configChanges(name, previous, s.pendingPath(current))
+		if err != nil {
+			return err
+		}
+		if hadPrevious {
+			firstStaging = false
+		}
+		report = append(report, lines...)
+
+		s.keepPrevious(current, previous)
+	}
+
+	switch {
+	case firstStaging:
+		s.Log.Info("No previous staging to compare the generated configs with")
+	case len(report) == 0:
+		s.Log.Info("Generated configs are unchanged since the previous staging")
+	default:
+		s.Log.Info("Generated configs changed since the previous staging:\n%s", strings.Join(report, "\n"))
+	}
+	return nil
+}
+
+func (s *Supplier) configChanges(name, previous, current string) ([]string, bool, error) {
+	hadPrevious, err := libbuildpack.FileExists(previous)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case !hadPrevious && current == "":
+		return nil, false, nil
+	case !hadPrevious:
+		return []string{fmt.Sprintf("  + %s", name)}, false, nil
+	case current == "":
+		return []string{fmt.Sprintf("  - %s", name)}, true, nil
+	}
+
+	before, err := flattenConfig(name, previous)
+	if err != nil {
+		s.Log.Warning("Unable to compare %s with the previous staging: %s", name, err.Error())
+		return nil, true, nil
+	}
+	after, err := flattenConfig(name, current)
+	if err != nil {
+		s.Log.Warning("Unable to compare %s with the previous staging: %s", name, err.Error())
+		return nil, true, nil
+	}
+
+	keys := map[string]bool{}
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, k := range sorted {
+		old, hadOld := before[k]
+		cur, hasCur := after[k]
+		switch {
+		case !hadOld:
+			lines = append(lines, fmt.Sprintf("    + %s = %s", k, redactSetting(k, cur)))
+		case !hasCur:
+			lines = append(lines, fmt.Sprintf("    - %s = %s", k, redactSetting(k, old)))
+		case old != cur:
+			lines = append(lines, fmt.Sprintf("    ~ %s: %s -> %s", k, redactSetting(k, old), redactSetting(k, cur)))
+		}
+	}
+	if len(lines) == 0 {
+		return nil, true, nil
+	}
+	return append([]string{fmt.Sprintf("  %s", name)}, lines...), true, nil
+}
+
+// keepPrevious copies the committed config into the cache dir. It runs as
+// part of Commit so a failed staging leaves the previous copy in place.
+func (s *Supplier) keepPrevious(current, previous string) {
+	s.generated = append(s.generated, generatedFile{
+		path: previous,
+		write: func() error {
+			if exists, err := libbuildpack.FileExists(current); err != nil || !exists {
+				return err
+			}
+			return libbuildpack.CopyFile(current, previous)
+		},
+	})
+}
+
+func redactSetting(key, value string) string {
+	last := strings.ToLower(key[strings.LastIndexAny(key, ".]")+1:])
+	for _, part := range secretKeyParts {
+		if strings.Contains(last, part) {
+			return redactedValue
+		}
+	}
+	return value
+}
+
+func flattenConfig(name, path string) (map[string]string, error) {
+	if filepath.Ext(name) == ".conf" {
+		return flattenHCL(path)
+	}
+
+	var doc interface{}
+	if err := libbuildpack.NewYAML().Load(path, &doc); err != nil {
+		return nil, err
+	}
+	flat := map[string]string{}
+	flattenYAML("", doc, flat)
+	return flat, nil
+}
+
+// flattenHCL turns the blocks and attributes of the agent config into dotted
+// keys, e.g. `plugins.NodeAttestor "cf_iic".plugin_data.landscape`.
+func flattenHCL(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	flat := map[string]string{}
+	var blocks []string
+	key := func(name string) string {
+		return strings.Join(append(append([]string{}, blocks...), name), ".")
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//"):
+		case line == "}":
+			if len(blocks) > 0 {
+				blocks = blocks[:len(blocks)-1]
+			}
+		case strings.HasSuffix(line, "{}"):
+			flat[key(strings.TrimSpace(strings.TrimSuffix(line, "{}")))] = "{}"
+		case strings.HasSuffix(line, "{"):
+			blocks = append(blocks, strings.TrimSpace(strings.TrimSuffix(line, "{")))
+		case strings.Contains(line, "="):
+			parts := strings.SplitN(line, "=", 2)
+			flat[key(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+	return flat, scanner.Err()
+}
+
+// flattenYAML keys list items by their `type` or `name` so reordered
+// sidecars or clusters do not show up as changes.
+func flattenYAML(prefix string, node interface{}, flat map[string]string) {
+	switch v := node.(type) {
+	case map[interface{}]interface{}:
+		for k, child := range v {
+			key := fmt.Sprintf("%v", k)
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenYAML(key, child, flat)
+		}
+	case []interface{}:
+		for i, child := range v {
+			label := fmt.Sprintf("%d", i)
+			if m, ok := child.(map[interface{}]interface{}); ok {
+				if id, ok := m["type"].(string); ok {
+					label = id
+				} else if id, ok := m["name"].(string); ok {
+					label = id
+				}
+			}
+			flattenYAML(fmt.Sprintf("%s[%s]", prefix, label), child, flat)
+		}
+	default:
+		flat[prefix] = fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,31 @@
+package supply
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strings"
+)
+
+const spireAllowUnsignedBuildpackEnv = "SPIRE_ALLOW_UNSIGNED_BUILDPACK"
+
+// VerifyChecksums checks the signed checksum manifest and every file it lists
+// before anything from the buildpack is installed. Only buildpack zips built
+// by the packager are signed; staging from a git checkout needs an explicit
+// opt-in.
+func (s *Supplier) VerifyChecksums() error {
+	files, err := checksums.Verify(s.Manifest.RootDir(), checksums.PublicKey)
+	if errors.Is(err, checksums.ErrUnsigned) {
+		if strings.ToLower(utils.EnvWithDefault(spireAllowUnsignedBuildpackEnv, "false")) == "true" {
+			s.Log.Warning("Buildpack is not signed; skipping checksum verification because `%s` is set", spireAllowUnsignedBuildpackEnv)
+			return nil
+		}
+		err = fmt.Errorf("%s; only buildpack zips built by the packager are signed, set `%s=true` to stage an unsigned checkout", err.Error(), spireAllowUnsignedBuildpackEnv)
+	}
+	if err != nil {
+		return &Error{Kind: ChecksumVerificationFailure, Err: err}
+	}
+	s.Log.Info("Verified checksums of %d buildpack file(s)", len(files))
+	return nil
+}
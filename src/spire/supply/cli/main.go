@@ -1,15 +1,24 @@
 package main
 
 import (
+	"flag"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/render"
 	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
 
+const defaultRenderStack = "cflinuxfs4"
+
 func main() {
-	logger := libbuildpack.NewLogger(os.Stdout)
+	logger := libbuildpack.NewLogger(supply.NewRedactingWriter(os.Stdout))
+
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(renderMain(logger, os.Args[2:]))
+	}
 
 	buildpackDir, err := libbuildpack.GetBuildpackDir()
 	if err != nil {
@@ -44,20 +53,92 @@ func main() {
 		os.Exit(13)
 	}
 
-	supplier := supply.New(stager, manifest, installer, logger, &libbuildpack.Command{})
+	cachingInstaller := supply.NewCachingInstaller(installer, manifest, stager.CacheDir(), logger)
+	supplier := supply.New(stager, manifest, cachingInstaller, logger, &libbuildpack.Command{})
+	supplier.AddHook(supply.CompileHooks(stager))
 
 	if err := supplier.Run(); err != nil {
-		os.Exit(14)
+		os.Exit(supply.ExitCode(err))
 	}
 
-	if err := stager.WriteConfigYml(nil); err != nil {
-		logger.Error("Error writing config.yml: %s", err.Error())
-		os.Exit(15)
-	}
-	if err = installer.CleanupAppCache(); err != nil {
+	if err = cachingInstaller.CleanupAppCache(); err != nil {
 		logger.Error("Unable to clean up app cache: %s", err)
 		os.Exit(19)
 	}
 
 	stager.StagingComplete()
 }
+
+func renderMain(logger *libbuildpack.Logger, args []string) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	outDir := flags.String("out", "", "directory to write the generated files to (required)")
+	appDir := flags.String("app-dir", ".", "application directory containing an optional buildpack.yml")
+	depsIdx := flags.String("idx", "0", "deps index to render paths for")
+	buildpackDir := flags.String("buildpack-dir", "", "buildpack root directory; defaults to the directory of this binary")
+	diffDir := flags.String("diff", "", "directory of an earlier render to compare the generated files with")
+	runtimeDepsDir := flags.String("runtime-deps-dir", "", "deps root the generated paths point to at runtime; defaults to /home/vcap/deps")
+	stack := flags.String("stack", "", "stack to resolve plugin versions for; defaults to $CF_STACK or "+defaultRenderStack)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *outDir == "" {
+		logger.Error("Missing required `-out` flag")
+		flags.Usage()
+		return 2
+	}
+
+	if *buildpackDir == "" {
+		dir, err := libbuildpack.GetBuildpackDir()
+		if err != nil {
+			logger.Error("Unable to determine buildpack directory: %s", err.Error())
+			return 9
+		}
+		*buildpackDir = dir
+	}
+
+	// outside Cloud Foundry nothing sets CF_STACK, which the manifest needs to
+	// resolve plugin versions
+	if *stack == "" {
+		*stack = os.Getenv("CF_STACK")
+	}
+	if *stack == "" {
+		*stack = defaultRenderStack
+	}
+	if err := os.Setenv("CF_STACK", *stack); err != nil {
+		logger.Error("Unable to set CF_STACK: %s", err.Error())
+		return 13
+	}
+
+	manifest, err := libbuildpack.NewManifest(*buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		return 10
+	}
+
+	if err := os.MkdirAll(filepath.Join(*outDir, *depsIdx), 0755); err != nil {
+		logger.Error("Unable to create output directory: %s", err.Error())
+		return 12
+	}
+
+	stager := render.NewStager(*outDir, *depsIdx, *appDir)
+	supplier := supply.New(stager, manifest, libbuildpack.NewInstaller(manifest), logger, &libbuildpack.Command{})
+	supplier.RuntimeDepsDir = *runtimeDepsDir
+	supplier.Local = true
+	if err := supplier.Render(); err != nil {
+		return supply.ExitCode(err)
+	}
+	logger.Info("Rendered configuration into %s", *outDir)
+
+	if *diffDir != "" {
+		changed, err := render.Diff(*diffDir, *outDir, logger.Output())
+		if err != nil {
+			logger.Error("Unable to compare with %s: %s", *diffDir, err.Error())
+			return 16
+		}
+		if !changed {
+			logger.Info("No changes compared with %s", *diffDir)
+		}
+	}
+
+	return 0
+}
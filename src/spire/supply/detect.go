@@ -0,0 +1,31 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"path/filepath"
+)
+
+var detectEnvs = []string{spireServerAddressEnv, spireServerPortEnv, spireTrustDomainEnv}
+
+func Detect(buildDir string) (bool, error) {
+	for _, key := range detectEnvs {
+		if utils.EnvWithDefault(key, "") != "" {
+			return true, nil
+		}
+	}
+
+	configPath := filepath.Join(buildDir, "buildpack.yml")
+	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+		return false, err
+	} else if !exists {
+		return false, nil
+	}
+
+	var config map[string]interface{}
+	if err := libbuildpack.NewYAML().Load(configPath, &config); err != nil {
+		return false, err
+	}
+	_, ok := config["spire-agent"]
+	return ok, nil
+}
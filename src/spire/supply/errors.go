@@ -0,0 +1,165 @@
+package supply
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strings"
+)
+
+type ErrorKind int
+
+const (
+	MissingConfiguration ErrorKind = iota + 1
+	InvalidConfiguration
+	AssetInstallFailure
+	TemplateRenderFailure
+	PluginVerificationFailure
+	ChecksumVerificationFailure
+	BeforeSupplyHookFailure
+	AfterSupplyHookFailure
+)
+
+const UnknownFailureExitCode = 14
+
+// errorKinds holds a hint for staging on Cloud Foundry and, where that hint
+// names cf commands, a localHint for runs outside the platform.
+var errorKinds = map[ErrorKind]struct {
+	name      string
+	exitCode  int
+	hint      string
+	localHint string
+}{
+	MissingConfiguration: {
+		name:      "missing configuration",
+		exitCode:  20,
+		hint:      "set the missing value with `cf set-env <app> <NAME> <value>` (or in buildpack.yml) and run `cf restage <app>`",
+		localHint: "set the missing value with `export <NAME>=<value>` (or set it in buildpack.yml) and run the command again",
+	},
+	InvalidConfiguration: {
+		name:      "invalid configuration",
+		exitCode:  21,
+		hint:      "correct the value named above with `cf set-env <app> <NAME> <value>` (or in buildpack.yml) and run `cf restage <app>`",
+		localHint: "correct the value named above with `export <NAME>=<value>` (or in buildpack.yml) and run the command again",
+	},
+	AssetInstallFailure: {
+		name:      "asset install failure",
+		exitCode:  22,
+		hint:      "the buildpack package is incomplete or the staging container ran out of disk; re-upload the buildpack or ask your platform operator",
+		localHint: "the buildpack directory is incomplete; point `-buildpack-dir` at a buildpack checkout or an unpacked buildpack zip",
+	},
+	TemplateRenderFailure: {
+		name:     "template render failure",
+		exitCode: 23,
+		hint:     "a config template could not be rendered; check the buildpack's templates directory and values containing quotes or newlines",
+	},
+	PluginVerificationFailure: {
+		name:     "plugin verification failure",
+		exitCode: 24,
+		hint:     "the plugin does not match the SHA-256 pinned in manifest.yml; pin another version under `spire-agent.plugins` in buildpack.yml or re-upload the buildpack",
+	},
+	ChecksumVerificationFailure: {
+		name:     "checksum verification failure",
+		exitCode: 25,
+		hint:     "the buildpack package is unsigned or was modified after it was signed; ask your platform operator to re-upload a buildpack built from a trusted release",
+	},
+	BeforeSupplyHookFailure: {
+		name:     "before supply hook failure",
+		exitCode: 12,
+		hint:     "a BeforeSupply or libbuildpack BeforeCompile hook of a buildpack extension failed before any step ran; see the error above",
+	},
+	AfterSupplyHookFailure: {
+		name:     "after supply hook failure",
+		exitCode: 16,
+		hint:     "an AfterSupply or libbuildpack AfterCompile hook of a buildpack extension rejected the staged files, none of which were put in place; see the error above",
+	},
+}
+
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Hint() string {
+	return errorKinds[e.Kind].hint
+}
+
+// LocalHint is the hint for runs outside Cloud Foundry, such as render.
+func (e *Error) LocalHint() string {
+	if hint := errorKinds[e.Kind].localHint; hint != "" {
+		return hint
+	}
+	return e.Hint()
+}
+
+func (k ErrorKind) String() string {
+	return errorKinds[k].name
+}
+
+func (k ErrorKind) ExitCode() int {
+	return errorKinds[k].exitCode
+}
+
+func ExitCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind.ExitCode()
+	}
+	return UnknownFailureExitCode
+}
+
+// classify tags err with kind unless a more specific kind was already assigned
+func classify(kind ErrorKind, err error) error {
+	var e *Error
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	if kind == AssetInstallFailure && strings.Contains(err.Error(), "sha256 mismatch") {
+		kind = PluginVerificationFailure
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func missingConfigError(format string, args ...interface{}) error {
+	return &Error{Kind: MissingConfiguration, Err: fmt.Errorf(format, args...)}
+}
+
+func invalidConfigError(format string, args ...interface{}) error {
+	return &Error{Kind: InvalidConfiguration, Err: fmt.Errorf(format, args...)}
+}
+
+func pluginVerificationError(format string, args ...interface{}) error {
+	return &Error{Kind: PluginVerificationFailure, Err: fmt.Errorf(format, args...)}
+}
+
+func (s *Supplier) fail(kind ErrorKind, err error, format string, args ...interface{}) error {
+	err = classify(kind, err)
+	s.Log.Error("%s; %s", fmt.Sprintf(format, args...), err.Error())
+
+	var e *Error
+	if errors.As(err, &e) {
+		s.Log.Error("Cause: %s (exit code %d)", e.Kind, e.Kind.ExitCode())
+		if s.Local {
+			s.Log.Info("Hint: %s", e.LocalHint())
+		} else {
+			s.Log.Info("Hint: %s", e.Hint())
+		}
+	}
+	return err
+}
+
+func requiredEnv(key string) (string, error) {
+	value, err := utils.Env(key)
+	if err != nil {
+		return "", &Error{Kind: MissingConfiguration, Err: err}
+	}
+	return value, nil
+}
@@ -0,0 +1,285 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const backupSuffix = ".spire-backup"
+
+// generatedFile is an artifact that is only put in place by Commit, either by
+// renaming an already rendered temp file, by running a deferred write, by
+// creating a missing directory or by removing a stale file.
+type generatedFile struct {
+	path   string
+	tmp    string
+	mode   os.FileMode
+	write  func() error
+	dir    bool
+	remove bool
+}
+
+func (s *Supplier) createGenerated(path string, mode os.FileMode) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	s.generated = append(s.generated, generatedFile{path: path, tmp: f.Name()})
+	return f, nil
+}
+
+func (s *Supplier) writeGenerated(path string, content []byte, mode os.FileMode) error {
+	f, err := s.createGenerated(path, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Supplier) copyGenerated(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	f, err := s.createGenerated(dst, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installGenerated puts a file an installer already wrote outside the deps
+// dir, e.g. into a scratchDir, in place at path on Commit, creating its
+// parent directory if nothing else does.
+func (s *Supplier) installGenerated(path, installed string) {
+	s.mkdirGenerated(filepath.Dir(path), 0755)
+	s.generated = append(s.generated, generatedFile{path: path, tmp: installed})
+}
+
+// mkdirGenerated creates path on Commit unless it already exists. Existing
+// directories, such as a disk key manager's keys, are left untouched.
+func (s *Supplier) mkdirGenerated(path string, mode os.FileMode) {
+	s.generated = append(s.generated, generatedFile{path: path, mode: mode, dir: true})
+}
+
+// removeGenerated removes path on Commit, a failed staging keeps it.
+func (s *Supplier) removeGenerated(path string) {
+	s.generated = append(s.generated, generatedFile{path: path, remove: true, write: func() error { return nil }})
+}
+
+// scratchDir returns a new directory under dir for installers that write
+// into a directory rather than a file. It is removed by Commit and Abort.
+func (s *Supplier) scratchDir(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	scratch, err := ioutil.TempDir(dir, ".install")
+	if err != nil {
+		return "", err
+	}
+	s.scratch = append(s.scratch, scratch)
+	return scratch, nil
+}
+
+// generates tells whether path will be put in place by the next Commit.
+func (s *Supplier) generates(path string) bool {
+	generates := false
+	for _, f := range s.generated {
+		if f.path == path {
+			generates = !f.remove
+		}
+	}
+	return generates
+}
+
+// pendingPath returns the file holding the content path will have after
+// Commit, or an empty string when there is none.
+func (s *Supplier) pendingPath(path string) string {
+	pending := ""
+	if exists, err := libbuildpack.FileExists(path); err == nil && exists {
+		pending = path
+	}
+	for _, f := range s.generated {
+		switch {
+		case f.path != path:
+		case f.remove:
+			pending = ""
+		case f.tmp != "":
+			pending = f.tmp
+		}
+	}
+	return pending
+}
+
+// pendingFiles maps every regular file under dir as it will be after Commit
+// to the file holding its content now. Deferred writes are not included.
+func (s *Supplier) pendingFiles(dir string) (map[string]string, error) {
+	temps := map[string]bool{}
+	for _, f := range s.generated {
+		if f.tmp != "" {
+			temps[f.tmp] = true
+		}
+	}
+	scratch := map[string]bool{}
+	for _, d := range s.scratch {
+		scratch[d] = true
+	}
+
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() && scratch[path] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && !temps[path] {
+			files[path] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	for _, f := range s.generated {
+		if !strings.HasPrefix(f.path, prefix) {
+			continue
+		}
+		switch {
+		case f.remove:
+			delete(files, f.path)
+		case f.tmp != "":
+			files[f.path] = f.tmp
+		}
+	}
+	return files, nil
+}
+
+func (s *Supplier) writeProfileD(scriptName, scriptContents string) error {
+	s.generated = append(s.generated, generatedFile{
+		path:  filepath.Join(s.Stager.DepDir(), "profile.d", scriptName),
+		write: func() error { return s.Stager.WriteProfileD(scriptName, scriptContents) },
+	})
+	return nil
+}
+
+func (s *Supplier) writeConfigYml(config interface{}) error {
+	s.generated = append(s.generated, generatedFile{
+		path:  filepath.Join(s.Stager.DepDir(), "config.yml"),
+		mode:  configMode,
+		write: func() error { return s.Stager.WriteConfigYml(config) },
+	})
+	return nil
+}
+
+func (s *Supplier) Commit() error {
+	type applied struct {
+		path   string
+		backup bool
+	}
+	var done []applied
+
+	rollback := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			os.Remove(done[i].path)
+			if done[i].backup {
+				os.Rename(done[i].path+backupSuffix, done[i].path)
+			}
+		}
+	}
+
+	for _, f := range s.generated {
+		exists, err := libbuildpack.FileExists(f.path)
+		if err != nil {
+			rollback()
+			s.Abort()
+			return err
+		}
+
+		if f.dir {
+			if exists {
+				continue
+			}
+			if err := os.MkdirAll(f.path, f.mode); err != nil {
+				rollback()
+				s.Abort()
+				return err
+			}
+			done = append(done, applied{path: f.path})
+			continue
+		}
+
+		if exists {
+			if err := os.Rename(f.path, f.path+backupSuffix); err != nil {
+				rollback()
+				s.Abort()
+				return err
+			}
+		}
+		done = append(done, applied{path: f.path, backup: exists})
+
+		if f.tmp != "" {
+			err = os.Rename(f.tmp, f.path)
+		} else {
+			err = f.write()
+			if err == nil && f.mode != 0 {
+				err = os.Chmod(f.path, f.mode)
+			}
+		}
+		if err != nil {
+			rollback()
+			s.Abort()
+			return err
+		}
+	}
+
+	for _, a := range done {
+		if a.backup {
+			os.Remove(a.path + backupSuffix)
+		}
+	}
+	s.generated = nil
+	s.Abort()
+	return nil
+}
+
+func (s *Supplier) Abort() {
+	for _, f := range s.generated {
+		if f.tmp != "" {
+			os.Remove(f.tmp)
+		}
+	}
+	for _, dir := range s.scratch {
+		os.RemoveAll(dir)
+	}
+	s.generated = nil
+	s.scratch = nil
+}
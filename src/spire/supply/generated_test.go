@@ -0,0 +1,135 @@
+package supply
+
+import (
+	"errors"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderErrorKeepsPreviousFiles(t *testing.T) {
+	testutil.StagingEnv(t, map[string]string{"SPIRE_ENVOY_PROXY": "true", "SPIRE_APPLICATION_SPIFFE_ID": "spiffe://example.org/app"})
+	staging := testutil.NewStaging(t, testutil.Buildpack(t))
+	manifest := staging.Manifest(t)
+	if err := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{}).Run(); err != nil {
+		t.Fatalf("first staging failed: %v", err)
+	}
+
+	names := []string{"launch.yml", "spire-agent.conf", "envoy-config.yaml", "config.yml"}
+	previous := map[string]string{}
+	for _, name := range names {
+		previous[name] = testutil.ReadFile(t, filepath.Join(staging.DepDir(), name))
+	}
+
+	// a restage that would change every file fails rendering the Envoy config,
+	// after the agent config is rendered
+	t.Setenv("SPIRE_TRUST_DOMAIN", "other.example.org")
+	testutil.WriteFile(t, filepath.Join(staging.BuildpackDir, "templates", "custom-envoy-conf.tmpl"), "{{ .Missing", 0644)
+	err := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{}).Run()
+	if ExitCode(err) != TemplateRenderFailure.ExitCode() {
+		t.Fatalf("expected a %s error, got %v", TemplateRenderFailure, err)
+	}
+
+	for _, name := range names {
+		if content := testutil.ReadFile(t, filepath.Join(staging.DepDir(), name)); content != previous[name] {
+			t.Errorf("expected %s to be kept\n%s\ngot\n%s", name, previous[name], content)
+		}
+	}
+	checkNoLeftovers(t, staging.DepDir())
+}
+
+func TestCommitRestoresBackups(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.conf")
+	created := filepath.Join(dir, "created.conf")
+	removed := filepath.Join(dir, "removed.conf")
+	testutil.WriteFile(t, existing, "previous", 0644)
+	testutil.WriteFile(t, removed, "previous", 0644)
+
+	s := &Supplier{Log: libbuildpack.NewLogger(ioutil.Discard)}
+	if err := s.writeGenerated(existing, []byte("new"), configMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeGenerated(created, []byte("new"), configMode); err != nil {
+		t.Fatal(err)
+	}
+	s.removeGenerated(removed)
+	scratch, err := s.scratchDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.generated = append(s.generated, generatedFile{path: filepath.Join(dir, "failing.yml"), write: func() error {
+		return errors.New("disk full")
+	}})
+
+	if err := s.Commit(); err == nil || err.Error() != "disk full" {
+		t.Fatalf("expected the failing write to fail Commit, got %v", err)
+	}
+
+	if content := testutil.ReadFile(t, existing); content != "previous" {
+		t.Errorf("expected the previous %s to be restored, got %q", existing, content)
+	}
+	if content := testutil.ReadFile(t, removed); content != "previous" {
+		t.Errorf("expected %s to be restored, got %q", removed, content)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be rolled back, got %v", created, err)
+	}
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Errorf("expected the scratch dir to be removed, got %v", err)
+	}
+	checkNoLeftovers(t, dir)
+}
+
+func TestAbortRemovesScratch(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "spire-agent.conf")
+	testutil.WriteFile(t, conf, "previous", 0644)
+
+	s := &Supplier{Log: libbuildpack.NewLogger(ioutil.Discard)}
+	if err := s.writeGenerated(conf, []byte("new"), configMode); err != nil {
+		t.Fatal(err)
+	}
+	scratch, err := s.scratchDir(filepath.Join(dir, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, filepath.Join(scratch, "cf_iic"), "plugin", 0755)
+	s.installGenerated(filepath.Join(dir, "bin", "cf_iic"), filepath.Join(scratch, "cf_iic"))
+
+	s.Abort()
+
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Errorf("expected the scratch dir to be removed, got %v", err)
+	}
+	if content := testutil.ReadFile(t, conf); content != "previous" {
+		t.Errorf("expected %s to be untouched, got %q", conf, content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin", "cf_iic")); !os.IsNotExist(err) {
+		t.Errorf("expected the plugin not to be installed, got %v", err)
+	}
+	if len(s.generated) != 0 || len(s.scratch) != 0 {
+		t.Errorf("expected nothing left to commit, got %d files and %d scratch dirs", len(s.generated), len(s.scratch))
+	}
+	checkNoLeftovers(t, dir)
+}
+
+// checkNoLeftovers fails on temp files, backups or scratch dirs under dir.
+func checkNoLeftovers(t *testing.T, dir string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name := info.Name(); path != dir && name[0] == '.' || filepath.Ext(name) == backupSuffix {
+			t.Errorf("expected no leftover %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strconv"
+	"strings"
+)
+
+const (
+	spireHealthChecksEnv     = "SPIRE_HEALTH_CHECKS"
+	spireHealthChecksPortEnv = "SPIRE_HEALTH_CHECKS_PORT"
+
+	defaultHealthChecksPort = "8089"
+	healthChecksLivePath    = "/live"
+	healthChecksReadyPath   = "/ready"
+)
+
+type HealthChecks struct {
+	Enabled bool
+	Port    string
+}
+
+func (h HealthChecks) LiveURL() string {
+	return fmt.Sprintf("http://localhost:%s%s", h.Port, healthChecksLivePath)
+}
+
+func (h HealthChecks) ReadyURL() string {
+	return fmt.Sprintf("http://localhost:%s%s", h.Port, healthChecksReadyPath)
+}
+
+func healthChecks() (HealthChecks, error) {
+	enabled := utils.EnvWithDefault(spireHealthChecksEnv, "false")
+	if strings.ToLower(enabled) != "true" {
+		return HealthChecks{}, nil
+	}
+
+	port, err := localPort(spireHealthChecksPortEnv, defaultHealthChecksPort)
+	if err != nil {
+		return HealthChecks{}, err
+	}
+
+	return HealthChecks{Enabled: true, Port: port}, nil
+}
+
+func localPort(key string, defValue string) (string, error) {
+	port := utils.EnvWithDefault(key, defValue)
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", invalidConfigError("invalid `%s` value `%s`; expected a port between 1 and 65535", key, port)
+	}
+	return port, nil
+}
+
+func (s *Supplier) healthChecksData(data map[string]interface{}) error {
+	hc, err := healthChecks()
+	if err != nil {
+		return err
+	}
+	if !hc.Enabled {
+		return nil
+	}
+
+	data["HealthChecksEnabled"] = true
+	data["HealthChecksPort"] = hc.Port
+	data["HealthChecksLivePath"] = healthChecksLivePath
+	data["HealthChecksReadyPath"] = healthChecksReadyPath
+	return nil
+}
+
+func (s *Supplier) WriteHealthChecksProfileD() error {
+	hc, err := healthChecks()
+	if err != nil {
+		return err
+	}
+	if !hc.Enabled {
+		return nil
+	}
+
+	return s.writeProfileD("spire-agent-health.sh", fmt.Sprintf("export SPIRE_AGENT_LIVE_URL=%s\nexport SPIRE_AGENT_READY_URL=%s\n", hc.LiveURL(), hc.ReadyURL()))
+}
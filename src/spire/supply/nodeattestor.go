@@ -0,0 +1,111 @@
+package supply
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strings"
+	"time"
+)
+
+const (
+	spireNodeAttestorEnv   = "SPIRE_NODE_ATTESTOR"
+	spireJoinTokenEnv      = "SPIRE_JOIN_TOKEN"
+	spireCfIicLandscapeEnv = "SPIRE_CF_IIC_LANDSCAPE"
+
+	joinTokenCredential = "join_token"
+)
+
+const (
+	cfIicNodeAttestor     = "cf_iic"
+	joinTokenNodeAttestor = "join_token"
+	x509popNodeAttestor   = "x509pop"
+)
+
+// InstanceCertPath and InstanceKeyPath are where Diego puts the app
+// instance identity credentials.
+const (
+	InstanceCertPath = "/etc/cf-instance-credentials/instance.crt"
+	InstanceKeyPath  = "/etc/cf-instance-credentials/instance.key"
+)
+
+func (s *Supplier) nodeAttestorData(data map[string]interface{}) error {
+	attestor := strings.ToLower(utils.EnvWithDefault(spireNodeAttestorEnv, cfIicNodeAttestor))
+	data["NodeAttestor"] = attestor
+	data["InstanceCertPath"] = InstanceCertPath
+	data["InstanceKeyPath"] = InstanceKeyPath
+
+	switch attestor {
+	case cfIicNodeAttestor:
+		if _, ok := s.Plugins[cfIicPlugin]; !ok {
+			return pluginVerificationError("node attestor `%s` requires plugin `%s`, which is not installed", cfIicNodeAttestor, cfIicPlugin)
+		}
+		data["CfIicLandscape"] = utils.EnvWithDefault(spireCfIicLandscapeEnv, "cf-eu10")
+	case joinTokenNodeAttestor:
+		token, err := joinToken()
+		if err != nil {
+			return err
+		}
+		data["JoinToken"] = token
+		s.Log.Info("Node attestor `%s` configured; token is not logged", joinTokenNodeAttestor)
+	case x509popNodeAttestor:
+		if err := s.checkInstanceCredentials(); err != nil {
+			return err
+		}
+	default:
+		return invalidConfigError("unsupported `%s` value `%s`; expected one of `%s`, `%s`, `%s`", spireNodeAttestorEnv, attestor, cfIicNodeAttestor, joinTokenNodeAttestor, x509popNodeAttestor)
+	}
+
+	return nil
+}
+
+func joinToken() (string, error) {
+	if token := utils.EnvWithDefault(spireJoinTokenEnv, ""); token != "" {
+		AddSecret(token)
+		return token, nil
+	}
+
+	token, found, err := utils.ServiceCredential(joinTokenCredential)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", missingConfigError("node attestor `%s` requires `%s` environment variable or a service binding with a `%s` credential", joinTokenNodeAttestor, spireJoinTokenEnv, joinTokenCredential)
+	}
+	AddSecret(token)
+	return token, nil
+}
+
+func (s *Supplier) checkInstanceCredentials() error {
+	certExists, err := libbuildpack.FileExists(InstanceCertPath)
+	if err != nil {
+		return err
+	}
+	keyExists, err := libbuildpack.FileExists(InstanceKeyPath)
+	if err != nil {
+		return err
+	}
+	if !certExists || !keyExists {
+		s.Log.Warning("Instance identity credentials are not available at staging; node attestor `%s` expects `%s` and `%s` at runtime", x509popNodeAttestor, InstanceCertPath, InstanceKeyPath)
+		return nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(InstanceCertPath, InstanceKeyPath)
+	if err != nil {
+		return invalidConfigError("invalid instance identity credentials for node attestor `%s`: %s", x509popNodeAttestor, err.Error())
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return invalidConfigError("invalid instance identity certificate `%s`: %s", InstanceCertPath, err.Error())
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return invalidConfigError("instance identity certificate `%s` can't be used for signatures, which node attestor `%s` requires", InstanceCertPath, x509popNodeAttestor)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return invalidConfigError("instance identity certificate `%s` expired at %s", InstanceCertPath, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package supply
+
+import (
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"path/filepath"
+)
+
+const (
+	spireRuntimeDepsDirEnv = "SPIRE_RUNTIME_DEPS_DIR"
+
+	supplyRuntimeDepsDir  = "/home/vcap/deps"
+	compileRuntimeDepsDir = "/home/vcap/app/.cloudfoundry"
+)
+
+func (s *Supplier) runtimeDepsDir() string {
+	if s.RuntimeDepsDir != "" {
+		return s.RuntimeDepsDir
+	}
+	if dir := utils.EnvWithDefault(spireRuntimeDepsDirEnv, ""); dir != "" {
+		return dir
+	}
+	// bin/compile stages into $BUILD_DIR/.cloudfoundry, which the app sees as $HOME/.cloudfoundry
+	if filepath.Clean(s.Stager.DepsDir()) == filepath.Join(s.Stager.BuildDir(), ".cloudfoundry") {
+		return compileRuntimeDepsDir
+	}
+	return supplyRuntimeDepsDir
+}
+
+func (s *Supplier) RuntimeDepDir() string {
+	return filepath.Join(s.runtimeDepsDir(), s.Stager.DepsIdx())
+}
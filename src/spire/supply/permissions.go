@@ -0,0 +1,74 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File modes per artifact type. Configs may carry join tokens and other
+// secrets, so only the app user can read them.
+const (
+	configMode      os.FileMode = 0600
+	binaryMode      os.FileMode = 0755
+	certificateMode os.FileMode = 0644
+	metadataMode    os.FileMode = 0644
+)
+
+// permissionPolicy returns the broadest mode allowed for a file in the deps
+// dir, or false for files the policy does not cover.
+func permissionPolicy(rel string) (os.FileMode, bool) {
+	switch {
+	case strings.HasPrefix(rel, "bin"+string(filepath.Separator)):
+		return binaryMode, true
+	case strings.HasPrefix(rel, "certificates"+string(filepath.Separator)):
+		return certificateMode, true
+	case filepath.Dir(rel) == ".":
+		switch filepath.Ext(rel) {
+		case ".conf", ".yaml", ".yml":
+			return configMode, true
+		}
+	}
+	return 0, false
+}
+
+// CheckPermissions reports every artifact whose mode after Commit would be
+// broader than the policy for its type.
+func (s *Supplier) CheckPermissions() error {
+	depDir := s.Stager.DepDir()
+	files, err := s.pendingFiles(depDir)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var broad int
+	for _, path := range paths {
+		rel, err := filepath.Rel(depDir, path)
+		if err != nil {
+			return err
+		}
+		policy, ok := permissionPolicy(rel)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(files[path])
+		if err != nil {
+			return err
+		}
+		if mode := info.Mode().Perm(); mode&^policy != 0 {
+			s.Log.Warning("`%s` has mode %04o, which is broader than %04o", rel, mode, policy)
+			broad++
+		}
+	}
+	if broad == 0 {
+		s.Log.Debug("All generated artifacts in %s have restrictive permissions", depDir)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strings"
+)
+
+const spireSkipStepsEnv = "SPIRE_SKIP_STEPS"
+
+type Step struct {
+	Name     string
+	Kind     ErrorKind
+	Message  string
+	Run      func() error
+	Required bool
+}
+
+// Hook lets an extension change the pipeline before it runs, e.g. with
+// AddStep, and inspect the result before the generated files are committed.
+// Hooks are registered on a supplier with AddHook; the supply CLI registers
+// CompileHooks so hooks added with libbuildpack.AddHook run as well.
+// A BeforeSupply error fails staging before any step runs, an AfterSupply
+// error fails it with nothing put in place.
+type Hook interface {
+	BeforeSupply(*Supplier) error
+	AfterSupply(*Supplier) error
+}
+
+type DefaultHook struct{}
+
+func (d DefaultHook) BeforeSupply(*Supplier) error { return nil }
+func (d DefaultHook) AfterSupply(*Supplier) error  { return nil }
+
+type compileHooks struct {
+	stager *libbuildpack.Stager
+}
+
+// CompileHooks runs the hooks registered with libbuildpack.AddHook as a
+// supply Hook: BeforeCompile before the first step and AfterCompile before
+// the generated files are committed.
+func CompileHooks(stager *libbuildpack.Stager) Hook {
+	return compileHooks{stager: stager}
+}
+
+func (h compileHooks) BeforeSupply(*Supplier) error {
+	return libbuildpack.RunBeforeCompile(h.stager)
+}
+
+func (h compileHooks) AfterSupply(*Supplier) error {
+	return libbuildpack.RunAfterCompile(h.stager)
+}
+
+func (s *Supplier) Steps() []Step {
+	return []Step{
+		{Name: "load-config", Kind: InvalidConfiguration, Message: "Unable to load buildpack.yml", Run: s.LoadConfig, Required: true},
+		{Name: "verify-checksums", Kind: ChecksumVerificationFailure, Message: "Buildpack checksum verification failed", Run: s.VerifyChecksums, Required: true},
+		{Name: "setup", Kind: AssetInstallFailure, Message: "Could not setup", Run: s.Setup},
+		{Name: "certificates", Kind: AssetInstallFailure, Message: "Failed to copy certificates", Run: s.InstallCertificates},
+		{Name: "trust-bundle", Kind: InvalidConfiguration, Message: "Failed to install the trust bundle", Run: s.InstallTrustBundle},
+		{Name: "ca-bundle", Kind: AssetInstallFailure, Message: "Failed to build the combined CA bundle", Run: s.WriteCABundle},
+		{Name: "spire-agent", Kind: AssetInstallFailure, Message: "Failed to copy spire-agent binary", Run: s.InstallSpireAgent},
+		{Name: "plugins", Kind: AssetInstallFailure, Message: "Failed to install plugins", Run: s.InstallSpireAgentPlugins},
+		{Name: "trust-bundle-url", Kind: InvalidConfiguration, Message: "Failed to verify the trust bundle URL", Run: s.VerifyTrustBundleURL},
+		{Name: "spire-agent-conf", Kind: TemplateRenderFailure, Message: "Failed to configure spire-agent.conf file", Run: s.CopySpireAgentConf},
+		{Name: "envoy", Kind: TemplateRenderFailure, Message: "Failed to configure envoy-config.yaml file", Run: s.WriteEnvoyConfig},
+		{Name: "launch", Kind: TemplateRenderFailure, Message: "Failed to create the sidecar processes", Run: s.CreateLaunchForSidecars},
+		{Name: "health-checks", Kind: InvalidConfiguration, Message: "Failed to write health checks profile.d script", Run: s.WriteHealthChecksProfileD},
+		{Name: "telemetry", Kind: InvalidConfiguration, Message: "Failed to write telemetry profile.d script", Run: s.WriteTelemetryProfileD},
+		{Name: "runtime-renderer", Kind: AssetInstallFailure, Message: "Failed to install the runtime config renderer", Run: s.InstallRuntimeRenderer},
+		{Name: "sbom", Kind: AssetInstallFailure, Message: "Failed to write the SBOM", Run: s.WriteSBOM},
+		{Name: "config-yml", Kind: AssetInstallFailure, Message: "Error writing config.yml", Run: s.WriteConfigYml},
+		{Name: "change-report", Kind: AssetInstallFailure, Message: "Failed to compare the generated configs with the previous staging", Run: s.ReportChanges},
+	}
+}
+
+var renderSteps = map[string]bool{
+	"load-config":      true,
+	"plugins":          true,
+	"trust-bundle-url": true,
+	"spire-agent-conf": true,
+	"envoy":            true,
+	"launch":           true,
+	"health-checks":    true,
+	"telemetry":        true,
+	"runtime-renderer": true,
+	"config-yml":       true,
+}
+
+func (s *Supplier) renderSteps() []Step {
+	var steps []Step
+	for _, step := range s.Steps() {
+		if !renderSteps[step.Name] {
+			continue
+		}
+		if step.Name == "plugins" {
+			step.Message = "Failed to resolve plugins"
+			step.Kind = InvalidConfiguration
+			step.Run = s.ResolvePlugins
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// AddStep inserts step right after the step named after, or at the end of the
+// pipeline when after is empty. Hooks use it from BeforeSupply.
+func (s *Supplier) AddStep(after string, step Step) error {
+	if after == "" {
+		s.steps = append(s.steps, step)
+		return nil
+	}
+
+	for i, existing := range s.steps {
+		if existing.Name == after {
+			s.steps = append(s.steps[:i+1], append([]Step{step}, s.steps[i+1:]...)...)
+			return nil
+		}
+	}
+	return invalidConfigError("can't add step `%s`; there is no step named `%s`", step.Name, after)
+}
+
+// AddHook registers a hook for the next Run or Render of this supplier.
+func (s *Supplier) AddHook(hook Hook) {
+	s.Hooks = append(s.Hooks, hook)
+}
+
+func (s *Supplier) runHooks(before bool) error {
+	for _, hook := range s.Hooks {
+		var err error
+		if before {
+			err = hook.BeforeSupply(s)
+		} else {
+			err = hook.AfterSupply(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Supplier) runPipeline(steps []Step) error {
+	s.steps = steps
+	s.ran = map[string]bool{}
+	defer s.Abort()
+	if err := s.runHooks(true); err != nil {
+		return s.fail(BeforeSupplyHookFailure, err, "BeforeSupply hook failed")
+	}
+
+	var skip map[string]bool
+	for _, step := range s.steps {
+		if skip[step.Name] && !step.Required {
+			s.Log.Info("Skipping step `%s`", step.Name)
+			continue
+		}
+
+		if err := step.Run(); err != nil {
+			return s.fail(step.Kind, err, step.Message)
+		}
+		s.ran[step.Name] = true
+
+		if skip == nil {
+			var err error
+			if skip, err = s.skippedSteps(); err != nil {
+				return s.fail(InvalidConfiguration, err, "Invalid list of skipped steps")
+			}
+		}
+	}
+
+	// nothing is put in place until every step, check and hook succeeded
+	if err := s.CheckPermissions(); err != nil {
+		return s.fail(AssetInstallFailure, err, "Failed to check permissions of generated files")
+	}
+
+	if err := s.runHooks(false); err != nil {
+		return s.fail(AfterSupplyHookFailure, err, "AfterSupply hook failed")
+	}
+
+	if err := s.Commit(); err != nil {
+		return s.fail(AssetInstallFailure, err, "Failed to put generated files in place")
+	}
+	return nil
+}
+
+// skippedSteps combines buildpack.yml `spire-agent.skip_steps` with the
+// comma separated SPIRE_SKIP_STEPS environment variable.
+func (s *Supplier) skippedSteps() (map[string]bool, error) {
+	names := append([]string{}, s.Config.SpireAgent.SkipSteps...)
+	for _, name := range strings.Split(utils.EnvWithDefault(spireSkipStepsEnv, ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	known := map[string]Step{}
+	for _, step := range s.steps {
+		known[step.Name] = step
+	}
+
+	skip := map[string]bool{}
+	for _, name := range names {
+		step, ok := known[name]
+		if !ok {
+			return nil, invalidConfigError("unknown step `%s` in `%s`", name, spireSkipStepsEnv)
+		}
+		if step.Required {
+			return nil, invalidConfigError("step `%s` can't be skipped", name)
+		}
+		skip[name] = true
+	}
+	return skip, nil
+}
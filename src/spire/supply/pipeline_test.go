@@ -0,0 +1,157 @@
+package supply
+
+import (
+	"errors"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingHook records the calls made to it and whether launch.yml was put
+// in place when AfterSupply ran.
+type recordingHook struct {
+	calls           []string
+	beforeErr       error
+	afterErr        error
+	step            *Step
+	launchCommitted bool
+	launchPending   bool
+}
+
+func (h *recordingHook) BeforeSupply(s *Supplier) error {
+	h.calls = append(h.calls, "before")
+	if h.step != nil {
+		if err := s.AddStep("config-yml", *h.step); err != nil {
+			return err
+		}
+	}
+	return h.beforeErr
+}
+
+func (h *recordingHook) AfterSupply(s *Supplier) error {
+	h.calls = append(h.calls, "after")
+	launch := filepath.Join(s.Stager.DepDir(), "launch.yml")
+	_, err := os.Stat(launch)
+	h.launchCommitted = err == nil
+	h.launchPending = s.generates(launch)
+	return h.afterErr
+}
+
+func TestHooks(t *testing.T) {
+	tests := []struct {
+		name        string
+		hook        *recordingHook
+		wantCalls   []string
+		wantStep    bool
+		wantErrKind ErrorKind
+	}{
+		{
+			name:      "both hooks run",
+			hook:      &recordingHook{},
+			wantCalls: []string{"before", "after"},
+		},
+		{
+			name:      "BeforeSupply adds a step",
+			hook:      &recordingHook{step: &Step{Name: "extension", Kind: AssetInstallFailure, Message: "Extension failed"}},
+			wantCalls: []string{"before", "after"},
+			wantStep:  true,
+		},
+		{
+			name:        "BeforeSupply fails",
+			hook:        &recordingHook{beforeErr: errors.New("not allowed")},
+			wantCalls:   []string{"before"},
+			wantErrKind: BeforeSupplyHookFailure,
+		},
+		{
+			name:        "AfterSupply fails",
+			hook:        &recordingHook{afterErr: errors.New("rejected")},
+			wantCalls:   []string{"before", "after"},
+			wantErrKind: AfterSupplyHookFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.StagingEnv(t, nil)
+			staging := testutil.NewStaging(t, testutil.Buildpack(t))
+			manifest := staging.Manifest(t)
+			s := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+
+			ran := false
+			if tt.hook.step != nil {
+				tt.hook.step.Run = func() error { ran = true; return nil }
+			}
+			s.AddHook(tt.hook)
+			err := s.Run()
+
+			if strings.Join(tt.hook.calls, ",") != strings.Join(tt.wantCalls, ",") {
+				t.Fatalf("expected hook calls %v, got %v", tt.wantCalls, tt.hook.calls)
+			}
+			_, statErr := os.Stat(filepath.Join(staging.DepDir(), "launch.yml"))
+
+			if tt.wantErrKind != 0 {
+				if ExitCode(err) != tt.wantErrKind.ExitCode() {
+					t.Fatalf("expected a %s error, got %v", tt.wantErrKind, err)
+				}
+				if !os.IsNotExist(statErr) {
+					t.Fatalf("expected no launch.yml after a failed hook, got %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.hook.launchCommitted || !tt.hook.launchPending {
+				t.Fatalf("expected AfterSupply to run before launch.yml is committed, committed: %t, pending: %t", tt.hook.launchCommitted, tt.hook.launchPending)
+			}
+			if statErr != nil {
+				t.Fatalf("expected launch.yml after Commit: %v", statErr)
+			}
+			if ran != tt.wantStep {
+				t.Fatalf("expected the added step to run: %t, got %t", tt.wantStep, ran)
+			}
+		})
+	}
+}
+
+type compileHook struct {
+	libbuildpack.DefaultHook
+	afterErr error
+	calls    *[]string
+}
+
+func (h compileHook) BeforeCompile(*libbuildpack.Stager) error {
+	*h.calls = append(*h.calls, "before")
+	return nil
+}
+
+func (h compileHook) AfterCompile(*libbuildpack.Stager) error {
+	*h.calls = append(*h.calls, "after")
+	return h.afterErr
+}
+
+func TestCompileHooks(t *testing.T) {
+	testutil.StagingEnv(t, nil)
+	staging := testutil.NewStaging(t, testutil.Buildpack(t))
+	manifest := staging.Manifest(t)
+	stager := staging.Stager(manifest)
+	s := New(stager, manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+
+	var calls []string
+	libbuildpack.AddHook(compileHook{afterErr: errors.New("rejected"), calls: &calls})
+	defer libbuildpack.ClearHooks()
+	s.AddHook(CompileHooks(stager))
+
+	if err := s.Run(); ExitCode(err) != AfterSupplyHookFailure.ExitCode() {
+		t.Fatalf("expected a %s error, got %v", AfterSupplyHookFailure, err)
+	}
+	if strings.Join(calls, ",") != "before,after" {
+		t.Fatalf("expected BeforeCompile and AfterCompile to run, got %v", calls)
+	}
+	if _, err := os.Stat(filepath.Join(staging.DepDir(), "launch.yml")); !os.IsNotExist(err) {
+		t.Fatalf("expected AfterCompile to fail staging before launch.yml is committed, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package supply
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue   = "[REDACTED]"
+	minSecretLength = 4
+)
+
+// secretEnvSuffixes name the settings whose values never reach the log.
+var secretEnvSuffixes = []string{"_TOKEN", "_PASSWORD", "_SECRET", "_PRIVATE_KEY"}
+
+var secrets []string
+var secretsLock sync.Mutex
+
+// AddSecret masks value in everything written through a RedactingWriter.
+func AddSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, s := range secrets {
+		if s == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+}
+
+// RedactingWriter is the output of the staging logger. It replaces every
+// registered secret before passing a message on.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter wraps w and registers the values of secret-bearing
+// environment variables.
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, suffix := range secretEnvSuffixes {
+			if strings.HasSuffix(parts[0], suffix) {
+				AddSecret(parts[1])
+			}
+		}
+	}
+	return &RedactingWriter{w: w}
+}
+
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	secretsLock.Lock()
+	msg := string(p)
+	for _, s := range secrets {
+		msg = strings.Replace(msg, s, redactedValue, -1)
+	}
+	secretsLock.Unlock()
+
+	if _, err := io.WriteString(r.w, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
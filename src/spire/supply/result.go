@@ -0,0 +1,98 @@
+package supply
+
+import (
+	"bytes"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"path/filepath"
+	"strings"
+)
+
+const AgentSocketPath = "/tmp/spire-agent/public/api.sock"
+
+type StagingResult struct {
+	SpireAgent  AgentResult             `yaml:"spire_agent"`
+	Plugins     map[string]PluginResult `yaml:"plugins"`
+	Configs     map[string]string       `yaml:"configs"`
+	SocketPath  string                  `yaml:"socket_path"`
+	TrustDomain string                  `yaml:"trust_domain,omitempty"`
+	SpiffeID    string                  `yaml:"spiffe_id,omitempty"`
+	EnvoyProxy  bool                    `yaml:"envoy_proxy"`
+	CABundle    string                  `yaml:"ca_bundle,omitempty"`
+	SBOM        string                  `yaml:"sbom,omitempty"`
+}
+
+type AgentResult struct {
+	Version string `yaml:"version"`
+	Path    string `yaml:"path"`
+}
+
+type PluginResult struct {
+	Version string `yaml:"version,omitempty"`
+	SHA256  string `yaml:"sha256"`
+	Path    string `yaml:"path"`
+}
+
+func (s *Supplier) StagingResult() StagingResult {
+	depDir := s.RuntimeDepDir()
+	result := StagingResult{
+		SpireAgent: AgentResult{
+			Version: s.spireAgentVersion(),
+			Path:    filepath.Join(depDir, "bin", "spire-agent"),
+		},
+		Plugins: map[string]PluginResult{},
+		Configs: map[string]string{
+			"spire_agent": filepath.Join(depDir, "spire-agent.conf"),
+			"launch":      filepath.Join(depDir, "launch.yml"),
+		},
+		SocketPath:  AgentSocketPath,
+		TrustDomain: utils.EnvWithDefault(spireTrustDomainEnv, ""),
+		SpiffeID:    utils.EnvWithDefault(spireApplicationSpiffeIdEnv, ""),
+		EnvoyProxy:  s.EnvoyProxy(),
+	}
+
+	for name, plugin := range s.Plugins {
+		result.Plugins[name] = PluginResult{
+			Version: plugin.Version,
+			SHA256:  plugin.SHA256,
+			Path:    filepath.Join(depDir, "bin", filepath.Base(plugin.Path)),
+		}
+	}
+
+	if exists, _ := libbuildpack.FileExists(filepath.Join(s.Stager.DepDir(), sbomName)); exists || s.generates(filepath.Join(s.Stager.DepDir(), sbomName)) {
+		result.SBOM = filepath.Join(depDir, sbomName)
+	}
+
+	if caBundleEnabled() {
+		result.CABundle = s.caBundlePath()
+	}
+
+	if result.EnvoyProxy {
+		result.Configs["envoy"] = filepath.Join(depDir, "envoy-config.yaml")
+	}
+
+	return result
+}
+
+func (s *Supplier) spireAgentVersion() string {
+	binary := s.pendingPath(filepath.Join(s.Stager.DepDir(), "bin", "spire-agent"))
+	if binary == "" {
+		return "unknown"
+	}
+
+	var out bytes.Buffer
+	if err := s.Command.Execute(s.Stager.DepDir(), &out, &out, binary, "--version"); err != nil {
+		s.Log.Debug("Unable to determine spire-agent version: %s", err.Error())
+		return "unknown"
+	}
+
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return fields[0]
+}
+
+func (s *Supplier) WriteConfigYml() error {
+	return s.writeConfigYml(s.StagingResult())
+}
@@ -0,0 +1,88 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	spireRuntimeRenderEnv       = "SPIRE_RUNTIME_RENDER"
+	spireRuntimeRenderStrictEnv = "SPIRE_RUNTIME_RENDER_STRICT"
+
+	runtimeRendererBinary = "spire-render-config"
+)
+
+func runtimeRenderEnabled() bool {
+	return strings.ToLower(utils.EnvWithDefault(spireRuntimeRenderEnv, "false")) == "true"
+}
+
+func (s *Supplier) InstallRuntimeRenderer() error {
+	if !runtimeRenderEnabled() {
+		return nil
+	}
+
+	templates, err := ioutil.ReadDir(filepath.Join(s.Manifest.RootDir(), "templates"))
+	if err != nil {
+		return err
+	}
+	for _, t := range templates {
+		if !t.Mode().IsRegular() {
+			continue
+		}
+		src := filepath.Join(s.Manifest.RootDir(), "templates", t.Name())
+		if err := s.copyGenerated(src, filepath.Join(s.Stager.DepDir(), "templates", t.Name()), metadataMode); err != nil {
+			return err
+		}
+	}
+	if err := s.copyGenerated(filepath.Join(s.Manifest.RootDir(), "manifest.yml"), filepath.Join(s.Stager.DepDir(), "manifest.yml"), configMode); err != nil {
+		return err
+	}
+
+	s.Log.Info("Configs will be rendered again from the runtime environment at container start")
+	return s.writeProfileD("0000_spire-render-config.sh", runtimeRenderScript(filepath.Join(s.RuntimeDepDir(), "bin", runtimeRendererBinary)))
+}
+
+func (s *Supplier) LoadInstalledPlugins(binDir string) error {
+	for _, name := range spirePlugins {
+		path := filepath.Join(binDir, name)
+		exists, err := libbuildpack.FileExists(path)
+		if err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		sum, err := checksums.SHA256File(path)
+		if err != nil {
+			return err
+		}
+
+		s.Plugins[name] = InstalledPlugin{
+			SHA256: sum,
+			Path:   path,
+		}
+	}
+
+	return nil
+}
+
+// runtimeRenderScript runs the renderer from profile.d. A failed render keeps
+// the configs from staging and only stops the container when
+// SPIRE_RUNTIME_RENDER_STRICT is true at runtime.
+func runtimeRenderScript(renderer string) string {
+	return fmt.Sprintf(`if ! "%[1]s"; then
+  case "$(echo "${%[2]s:-false}" | tr '[:upper:]' '[:lower:]')" in
+    true)
+      echo "%[3]s failed; stopping as %[2]s is true" >&2
+      exit 1
+      ;;
+  esac
+  echo "%[3]s failed; the agent and Envoy keep the configs from staging" >&2
+fi
+`, renderer, spireRuntimeRenderStrictEnv, runtimeRendererBinary)
+}
@@ -0,0 +1,49 @@
+package supply
+
+import (
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeRenderScript(t *testing.T) {
+	tests := []struct {
+		name       string
+		exitCode   string
+		strict     string
+		wantFailed bool
+		wantOutput string
+	}{
+		{name: "render succeeds", exitCode: "0", wantOutput: "started"},
+		{name: "render fails", exitCode: "21", wantOutput: "keep the configs from staging"},
+		{name: "render fails in strict mode", exitCode: "21", strict: "TRUE", wantFailed: true, wantOutput: "stopping as SPIRE_RUNTIME_RENDER_STRICT is true"},
+		{name: "render succeeds in strict mode", exitCode: "0", strict: "true", wantOutput: "started"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			renderer := filepath.Join(dir, runtimeRendererBinary)
+			testutil.WriteFile(t, renderer, "#!/bin/sh\nexit "+tt.exitCode+"\n", 0755)
+			script := filepath.Join(dir, "0000_spire-render-config.sh")
+			testutil.WriteFile(t, script, runtimeRenderScript(renderer), 0644)
+
+			// the launcher sources profile.d scripts before starting the app
+			cmd := exec.Command("bash", "-c", `source "$1" && echo started`, "bash", script)
+			cmd.Env = []string{spireRuntimeRenderStrictEnv + "=" + tt.strict, "PATH=/usr/bin:/bin"}
+			output, err := cmd.CombinedOutput()
+
+			if tt.wantFailed != (err != nil) {
+				t.Fatalf("expected the container start to fail: %t, got %v:\n%s", tt.wantFailed, err, output)
+			}
+			if !strings.Contains(string(output), tt.wantOutput) {
+				t.Fatalf("expected %q in the output, got:\n%s", tt.wantOutput, output)
+			}
+			if !tt.wantFailed && !strings.Contains(string(output), "started") {
+				t.Fatalf("expected the app to start, got:\n%s", output)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package supply
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/checksums"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	sbomName    = "sbom.cdx.json"
+	envoyBinary = "/etc/cf-assets/envoy/envoy"
+)
+
+type cycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXComponent struct {
+	Type               string              `json:"type"`
+	Name               string              `json:"name"`
+	Version            string              `json:"version,omitempty"`
+	Purl               string              `json:"purl,omitempty"`
+	Hashes             []cycloneDXHash     `json:"hashes,omitempty"`
+	ExternalReferences []cycloneDXExternal `json:"externalReferences,omitempty"`
+	Properties         []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXExternal struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WriteSBOM writes a CycloneDX SBOM of everything the supplier installed into
+// the deps dir, config.yml points platform scanners at it.
+func (s *Supplier) WriteSBOM() error {
+	components, err := s.sbomComponents()
+	if err != nil {
+		return err
+	}
+
+	serial, err := uuid()
+	if err != nil {
+		return err
+	}
+
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Component: cycloneDXComponent{
+				Type:    "application",
+				Name:    "spire-agent-sidecar-buildpack",
+				Version: s.buildpackVersion(),
+			},
+		},
+		Components: components,
+	}
+
+	content, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeGenerated(filepath.Join(s.Stager.DepDir(), sbomName), append(content, '\n'), metadataMode); err != nil {
+		return err
+	}
+	s.Log.Info("SBOM lists %d component(s)", len(components))
+	return nil
+}
+
+func (s *Supplier) sbomComponents() ([]cycloneDXComponent, error) {
+	var components []cycloneDXComponent
+
+	if agent := s.pendingPath(filepath.Join(s.Stager.DepDir(), "bin", "spire-agent")); agent != "" {
+		c, err := binaryComponent("spire-agent", s.spireAgentVersion(), agent)
+		if err != nil {
+			return nil, err
+		}
+		c.Properties = source("buildpack:binaries/spire-agent")
+		components = append(components, c)
+	}
+
+	for _, name := range spirePlugins {
+		plugin, ok := s.Plugins[name]
+		if !ok {
+			continue
+		}
+		c := cycloneDXComponent{
+			Type:    "application",
+			Name:    name,
+			Version: plugin.Version,
+			Purl:    purl(name, plugin.Version),
+			Hashes:  []cycloneDXHash{{Alg: "SHA-256", Content: plugin.SHA256}},
+		}
+		entry, err := s.Manifest.GetEntry(libbuildpack.Dependency{Name: name, Version: plugin.Version})
+		if err != nil {
+			return nil, err
+		}
+		if entry.File != "" {
+			c.Properties = source("buildpack:" + entry.File)
+		}
+		if entry.URI != "" {
+			c.ExternalReferences = []cycloneDXExternal{{Type: "distribution", URL: entry.URI}}
+		}
+		components = append(components, c)
+	}
+
+	if s.EnvoyProxy() {
+		if exists, err := libbuildpack.FileExists(envoyBinary); err != nil {
+			return nil, err
+		} else if exists {
+			c, err := binaryComponent("envoy", s.envoyVersion(), envoyBinary)
+			if err != nil {
+				return nil, err
+			}
+			c.Properties = source("stack:" + envoyBinary)
+			components = append(components, c)
+		} else {
+			components = append(components, cycloneDXComponent{Type: "application", Name: "envoy", Properties: source("stack:" + envoyBinary)})
+		}
+	}
+
+	certs, err := s.certificateFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range utils.SortedKeys(certs) {
+		sum, err := checksums.SHA256File(certs[name])
+		if err != nil {
+			return nil, err
+		}
+		components = append(components, cycloneDXComponent{
+			Type:       "file",
+			Name:       "certificates/" + name,
+			Hashes:     []cycloneDXHash{{Alg: "SHA-256", Content: sum}},
+			Properties: source("staging"),
+		})
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c, err := binaryComponent("supply", s.buildpackVersion(), executable)
+	if err != nil {
+		return nil, err
+	}
+	c.Properties = source("buildpack:src/spire/supply/cli")
+	components = append(components, c)
+
+	return components, nil
+}
+
+// certificateFiles maps the certificates in the deps dir to the file holding
+// their content, which is still a temp file for generated ones.
+func (s *Supplier) certificateFiles() (map[string]string, error) {
+	dir := filepath.Join(s.Stager.DepDir(), "certificates")
+	pending, err := s.pendingFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]string{}
+	for path, content := range pending {
+		if filepath.Dir(path) == dir {
+			files[filepath.Base(path)] = content
+		}
+	}
+	return files, nil
+}
+
+func (s *Supplier) buildpackVersion() string {
+	version, err := ioutil.ReadFile(filepath.Join(s.Manifest.RootDir(), "VERSION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(version))
+}
+
+func (s *Supplier) envoyVersion() string {
+	var out bytes.Buffer
+	if err := s.Command.Execute(s.Stager.DepDir(), &out, &out, envoyBinary, "--version"); err != nil {
+		s.Log.Debug("Unable to determine envoy version: %s", err.Error())
+		return ""
+	}
+
+	// envoy  version: <sha>/<version>/Clean/RELEASE/BoringSSL
+	for _, field := range strings.Split(out.String(), "/") {
+		if len(field) > 0 && field[0] >= '0' && field[0] <= '9' && strings.Count(field, ".") == 2 {
+			return field
+		}
+	}
+	return ""
+}
+
+func binaryComponent(name, version, path string) (cycloneDXComponent, error) {
+	sum, err := checksums.SHA256File(path)
+	if err != nil {
+		return cycloneDXComponent{}, err
+	}
+	if version == "unknown" {
+		version = ""
+	}
+	return cycloneDXComponent{
+		Type:    "application",
+		Name:    name,
+		Version: version,
+		Purl:    purl(name, version),
+		Hashes:  []cycloneDXHash{{Alg: "SHA-256", Content: sum}},
+	}, nil
+}
+
+func purl(name, version string) string {
+	if version == "" {
+		return ""
+	}
+	return fmt.Sprintf("pkg:generic/%s@%s", name, version)
+}
+
+func source(value string) []cycloneDXProperty {
+	return []cycloneDXProperty{{Name: "spire-agent-sidecar-buildpack:source", Value: value}}
+}
+
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
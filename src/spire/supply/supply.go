@@ -1,15 +1,21 @@
 package supply
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
-	"html/template"
+	"hash/fnv"
 	"io"
-	"math/rand"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
 )
 
 const (
@@ -19,8 +25,34 @@ const (
 	spireEnvoyProxyEnv            = "SPIRE_ENVOY_PROXY"
 	spireApplicationSpiffeIdEnv   = "SPIRE_APPLICATION_SPIFFE_ID"
 	spireCloudFoundrySVIDStoreEnv = "SPIRE_CLOUDFOUNDRY_SVID_STORE"
+	spireKeyManagerEnv            = "SPIRE_KEY_MANAGER"
+	spireKeyManagerDirEnv         = "SPIRE_KEY_MANAGER_DIR"
 )
 
+const (
+	memoryKeyManager     = "memory"
+	diskKeyManager       = "disk"
+	defaultKeyManagerDir = "spire-agent-keys"
+)
+
+const (
+	cfIicPlugin       = "cf_iic"
+	svidStoreCfPlugin = "svidstore-cf"
+)
+
+var spirePlugins = []string{cfIicPlugin, svidStoreCfPlugin}
+
+// templateFuncs are the functions the config templates can call. quote
+// renders a value as a double quoted string with its quotes, backslashes and
+// control characters escaped, which HCL and YAML both read back as is.
+var templateFuncs = template.FuncMap{
+	"quote": func(v interface{}) string { return strconv.Quote(fmt.Sprint(v)) },
+}
+
+func parseTemplate(path string) (*template.Template, error) {
+	return template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+}
+
 type Command interface {
 	Execute(string, io.Writer, io.Writer, string, ...string) error
 	Output(string, string, ...string) (string, error)
@@ -30,6 +62,7 @@ type Command interface {
 type Manifest interface {
 	DefaultVersion(depName string) (libbuildpack.Dependency, error)
 	AllDependencyVersions(string) []string
+	GetEntry(dep libbuildpack.Dependency) (*libbuildpack.ManifestEntry, error)
 	RootDir() string
 }
 
@@ -45,6 +78,7 @@ type Stager interface {
 	DepsDir() string
 	BuildDir() string
 	WriteProfileD(string, string) error
+	WriteConfigYml(interface{}) error
 }
 
 type Config struct {
@@ -53,7 +87,15 @@ type Config struct {
 }
 
 type SpireAgentConfig struct {
-	Version string `yaml:"version"`
+	Version   string            `yaml:"version"`
+	Plugins   map[string]string `yaml:"plugins"`
+	SkipSteps []string          `yaml:"skip_steps"`
+}
+
+type InstalledPlugin struct {
+	Version string
+	SHA256  string
+	Path    string
 }
 
 type Supplier struct {
@@ -64,6 +106,21 @@ type Supplier struct {
 	Config       Config
 	Command      Command
 	VersionLines map[string]string
+	Plugins      map[string]InstalledPlugin
+
+	RuntimeDepsDir string
+	HTTPClient     *http.Client
+	TrustBundleURL *TrustBundleURL
+	// Local marks runs outside Cloud Foundry, such as render, so failure
+	// hints do not point at cf commands.
+	Local bool
+
+	Hooks []Hook
+
+	steps     []Step
+	ran       map[string]bool
+	generated []generatedFile
+	scratch   []string
 }
 
 func New(stager Stager, manifest Manifest, installer Installer, logger *libbuildpack.Logger, command Command) *Supplier {
@@ -73,72 +130,82 @@ func New(stager Stager, manifest Manifest, installer Installer, logger *libbuild
 		Installer: installer,
 		Log:       logger,
 		Command:   command,
+		Plugins:   map[string]InstalledPlugin{},
 	}
 }
 
 func (s *Supplier) Run() error {
 	s.Log.BeginStep("Supplying spire")
 
-	if err := s.InstallCertificates(); err != nil {
-		s.Log.Error("Failed to copy certificates; %s", err.Error())
-		return err
-	}
-
-	if err := s.CopySpireAgentConf(); err != nil {
-		s.Log.Error("Failed to configure spire-agent.conf file; %s", err.Error())
-		return err
-	}
+	return s.runPipeline(s.Steps())
+}
 
-	if err := s.InstallSpireAgent(); err != nil {
-		s.Log.Error("Failed to copy spire-agent binary; %s", err.Error())
-		return err
-	}
+func (s *Supplier) Render() error {
+	return s.runPipeline(s.renderSteps())
+}
 
-	if err := s.InstallSpireAgentPlugins(); err != nil {
-		s.Log.Error("Failed to copy plugins; %s", err.Error())
-		return err
+func (s *Supplier) RenderRuntimeConfigs() error {
+	if err := s.VerifyTrustBundleURL(); err != nil {
+		return s.fail(InvalidConfiguration, err, "Failed to verify the trust bundle URL")
 	}
 
-	if err := s.CreateLaunchForSidecars(); err != nil {
-		s.Log.Error("Failed to create the sidecar processes; %s", err.Error())
-		return err
+	if err := s.CopySpireAgentConf(); err != nil {
+		return s.fail(TemplateRenderFailure, err, "Failed to configure spire-agent.conf file")
 	}
 
-	if err := s.Setup(); err != nil {
-		s.Log.Error("Could not setup; %s", err.Error())
-		return err
+	if err := s.WriteEnvoyConfig(); err != nil {
+		return s.fail(TemplateRenderFailure, err, "Failed to configure envoy-config.yaml file")
 	}
 
 	return nil
 }
 
 func (s *Supplier) InstallSpireAgent() error {
-	if exists, err := libbuildpack.FileExists(filepath.Join(s.Stager.DepDir(), "bin", "spire-agent")); err != nil {
+	src := filepath.Join(s.Manifest.RootDir(), "binaries", "spire-agent")
+	f, err := s.createGenerated(filepath.Join(s.Stager.DepDir(), "bin", "spire-agent"), binaryMode)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
 		return err
-	} else if exists {
-		return nil
 	}
 
-	return libbuildpack.CopyFile(filepath.Join(s.Manifest.RootDir(), "binaries", "spire-agent"), filepath.Join(s.Stager.DepDir(), "bin", "spire-agent"))
+	if fi, ok := s.Installer.(fileInstaller); ok {
+		return fi.InstallFile(src, f.Name())
+	}
+	return libbuildpack.CopyFile(src, f.Name())
 }
 
 func (s *Supplier) InstallCertificates() error {
 	pluginsDir := filepath.Join(s.Manifest.RootDir(), "certificates")
 
 	err := filepath.Walk(pluginsDir, func(srcPath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
 		if err != nil {
 			s.Log.Error("Can't copy certificate: %s", err.Error())
 			return err
 		}
+		if info.IsDir() {
+			return nil
+		}
 		dstPath := filepath.Join(s.Stager.DepDir(), "certificates", info.Name())
-		if errCopy := libbuildpack.CopyFile(srcPath, dstPath); errCopy != nil {
+		if errCopy := s.copyGenerated(srcPath, dstPath, certificateMode); errCopy != nil {
 			s.Log.Error("Can't copy file: %s; Source `%s`, destination `%s`", errCopy.Error(), srcPath, dstPath)
 			return errCopy
 		}
-		return nil
+
+		content, err := ioutil.ReadFile(srcPath)
+		if err != nil {
+			return err
+		}
+		certs, err := parseBundle(content, detectBundleFormat(content))
+		if err != nil {
+			s.Log.Warning("Can't parse certificate `%s`: %s", info.Name(), err.Error())
+			return nil
+		}
+		if err := s.checkCertificates(certs, fmt.Sprintf("buildpack file `%s`", info.Name()), false); err != nil {
+			return err
+		}
+		return s.convertSpiffeBundle(srcPath, content, certs)
 	})
 	if err != nil {
 		return err
@@ -146,41 +213,97 @@ func (s *Supplier) InstallCertificates() error {
 	return nil
 }
 
+// convertSpiffeBundle writes a PEM copy next to a SPIFFE bundle shipped in
+// the buildpack so Envoy and apps, which only read PEM, can use it.
+func (s *Supplier) convertSpiffeBundle(srcPath string, content []byte, certs []*x509.Certificate) error {
+	if detectBundleFormat(content) != spiffeBundleFormat {
+		return nil
+	}
+
+	name := strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath)) + ".crt"
+	if exists, err := libbuildpack.FileExists(filepath.Join(filepath.Dir(srcPath), name)); err != nil || exists {
+		return err
+	}
+
+	s.Log.Debug("Converting SPIFFE bundle `%s` to `%s`", filepath.Base(srcPath), name)
+	return s.writeGenerated(filepath.Join(s.Stager.DepDir(), "certificates", name), encodeCertificates(certs), certificateMode)
+}
+
 func (s *Supplier) InstallSpireAgentPlugins() error {
-	pluginsDir := filepath.Join(s.Manifest.RootDir(), "binaries", "plugins")
+	if err := s.ResolvePlugins(); err != nil {
+		return err
+	}
 
-	err := filepath.Walk(pluginsDir, func(srcPath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
+	// plugins are installed next to the bin dir and only moved into it by
+	// Commit
+	installDir, err := s.scratchDir(s.Stager.DepDir())
+	if err != nil {
+		return err
+	}
+	for _, name := range spirePlugins {
+		plugin := s.Plugins[name]
+		dep := libbuildpack.Dependency{Name: name, Version: plugin.Version}
+		if err := s.Installer.InstallDependency(dep, installDir); err != nil {
+			s.Log.Error("Can't install plugin %s %s: %s", dep.Name, dep.Version, err.Error())
+			return err
 		}
+
+		installed := filepath.Join(installDir, filepath.Base(plugin.Path))
+		if err := os.Chmod(installed, binaryMode); err != nil {
+			return err
+		}
+		s.installGenerated(plugin.Path, installed)
+	}
+
+	return nil
+}
+
+func (s *Supplier) ResolvePlugins() error {
+	binDir := filepath.Join(s.Stager.DepDir(), "bin")
+
+	for _, name := range spirePlugins {
+		dep, err := s.pluginDependency(name)
 		if err != nil {
-			s.Log.Error("Can't copy file: %s", err.Error())
 			return err
 		}
-		dstPath := filepath.Join(s.Stager.DepDir(), "bin", info.Name())
-		if errCopy := libbuildpack.CopyFile(srcPath, dstPath); errCopy != nil {
-			s.Log.Error("Can't copy file: %s; Source `%s`, destination `%s`", errCopy.Error(), srcPath, dstPath)
-			return errCopy
-		} else {
-			s.Log.Error("Copy file from Source `%s`, destination `%s`", srcPath, dstPath)
+
+		entry, err := s.Manifest.GetEntry(dep)
+		if err != nil {
+			return err
 		}
 
-		return nil
-	})
-	if err != nil {
-		return err
+		s.Plugins[name] = InstalledPlugin{
+			Version: dep.Version,
+			SHA256:  entry.SHA256,
+			Path:    filepath.Join(binDir, filepath.Base(entry.URI)),
+		}
 	}
 
 	return nil
 }
 
+func (s *Supplier) pluginDependency(name string) (libbuildpack.Dependency, error) {
+	constraint, ok := s.Config.SpireAgent.Plugins[name]
+	if !ok || constraint == "" {
+		return s.Manifest.DefaultVersion(name)
+	}
+
+	versions := s.Manifest.AllDependencyVersions(name)
+	version, err := libbuildpack.FindMatchingVersion(constraint, versions)
+	if err != nil {
+		return libbuildpack.Dependency{}, invalidConfigError("no version of plugin `%s` matches `%s`; available versions: %s", name, constraint, strings.Join(versions, ", "))
+	}
+
+	return libbuildpack.Dependency{Name: name, Version: version}, nil
+}
+
 func (s *Supplier) CreateLaunchForSidecars() error {
 	launch := filepath.Join(s.Stager.DepDir(), "launch.yml")
 	if _, err := libbuildpack.FileExists(launch); err != nil {
 		return err
 	}
 
-	launchFile, err := os.Create(launch)
+	launchFile, err := s.createGenerated(launch, configMode)
 	if err != nil {
 		return err
 	}
@@ -188,60 +311,39 @@ func (s *Supplier) CreateLaunchForSidecars() error {
 	launchFile.WriteString("---\nprocesses:\n")
 
 	spireAgentSidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "spire_agent-sidecar.tmpl")
-	spireAgentSidecar := template.Must(template.ParseFiles(spireAgentSidecarTmpl))
+	spireAgentSidecar, err := parseTemplate(spireAgentSidecarTmpl)
+	if err != nil {
+		return classify(TemplateRenderFailure, err)
+	}
 	err = spireAgentSidecar.Execute(launchFile, map[string]interface{}{
-		"Idx": s.Stager.DepsIdx(),
+		"Idx":    s.Stager.DepsIdx(),
+		"DepDir": s.RuntimeDepDir(),
 	})
 	if err != nil {
-		return err
+		return classify(TemplateRenderFailure, err)
 	}
 
-	envoyProxy := utils.EnvWithDefault(spireEnvoyProxyEnv, "false")
-	if strings.ToLower(envoyProxy) == "true" {
-		envoyConfig := filepath.Join(s.Stager.DepDir(), "envoy-config.yaml")
-		if _, err := libbuildpack.FileExists(launch); err != nil {
-			return err
-		}
-
-		envoyConfigFile, err := os.Create(envoyConfig)
-		if err != nil {
-			return err
-		}
-
-		envoyProxyConfigTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "custom-envoy-conf.tmpl")
-		envoyProxyConfig := template.Must(template.ParseFiles(envoyProxyConfigTmpl))
-
-		std, err := utils.Env(spireTrustDomainEnv)
+	if s.EnvoyProxy() {
+		envoyProxySidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "envoy_proxy-sidecar.tmpl")
+		envoyProxySidecar, err := parseTemplate(envoyProxySidecarTmpl)
 		if err != nil {
-			return err
+			return classify(TemplateRenderFailure, err)
 		}
-		sasid, err := utils.Env(spireApplicationSpiffeIdEnv)
-		if err != nil {
-			return err
+		envoyProxySidecarData := map[string]interface{}{
+			"Idx":    s.Stager.DepsIdx(),
+			"DepDir": s.RuntimeDepDir(),
+			"BaseId": EnvoyBaseID(),
 		}
-
-		err = envoyProxyConfig.Execute(envoyConfigFile, map[string]interface{}{
-			"Idx":         s.Stager.DepsIdx(),
-			"SpiffeID":    sasid,
-			"TrustDomain": std,
-		})
+		hc, err := healthChecks()
 		if err != nil {
 			return err
 		}
-
-		err = envoyConfigFile.Close()
-		if err != nil {
-			return err
+		if hc.Enabled {
+			envoyProxySidecarData["AgentReadyURL"] = hc.ReadyURL()
 		}
-
-		envoyProxySidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "envoy_proxy-sidecar.tmpl")
-		envoyProxySidecar := template.Must(template.ParseFiles(envoyProxySidecarTmpl))
-		err = envoyProxySidecar.Execute(launchFile, map[string]interface{}{
-			"Idx":    s.Stager.DepsIdx(),
-			"BaseId": rand.Int63n(65000),
-		})
+		err = envoyProxySidecar.Execute(launchFile, envoyProxySidecarData)
 		if err != nil {
-			return err
+			return classify(TemplateRenderFailure, err)
 		}
 	}
 
@@ -253,13 +355,99 @@ func (s *Supplier) CreateLaunchForSidecars() error {
 	return nil
 }
 
+// EnvoyBaseID returns the shared memory base id of the Envoy sidecar. It is
+// never the default 0 of the platform's own Envoy and is derived from the app
+// GUID, so restaging the same app renders the same launch.yml.
+func EnvoyBaseID() uint32 {
+	var app struct {
+		ApplicationID string `json:"application_id"`
+	}
+	if err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &app); err != nil || app.ApplicationID == "" {
+		return 1
+	}
+	h := fnv.New32a()
+	h.Write([]byte(app.ApplicationID))
+	return h.Sum32()%64999 + 1
+}
+
+// EnvoyProxyEnabled tells whether the app asked for the Envoy proxy sidecar.
+func EnvoyProxyEnabled() bool {
+	envoyProxy := utils.EnvWithDefault(spireEnvoyProxyEnv, "false")
+	return strings.ToLower(envoyProxy) == "true"
+}
+
+// EnvoyProxy tells whether this staging set up the Envoy proxy sidecar: it
+// was asked for and the `envoy` step was not skipped. A supplier that has not
+// run the pipeline, such as finalize's, goes by the config alone.
+func (s *Supplier) EnvoyProxy() bool {
+	if s.ran == nil {
+		return EnvoyProxyEnabled()
+	}
+	return EnvoyProxyEnabled() && s.ran["envoy"]
+}
+
+func (s *Supplier) WriteEnvoyConfig() error {
+	if !EnvoyProxyEnabled() {
+		return nil
+	}
+
+	envoyConfig := filepath.Join(s.Stager.DepDir(), "envoy-config.yaml")
+	if _, err := libbuildpack.FileExists(envoyConfig); err != nil {
+		return err
+	}
+
+	envoyConfigFile, err := s.createGenerated(envoyConfig, configMode)
+	if err != nil {
+		return err
+	}
+
+	envoyProxyConfigTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "custom-envoy-conf.tmpl")
+	envoyProxyConfig, err := parseTemplate(envoyProxyConfigTmpl)
+	if err != nil {
+		return classify(TemplateRenderFailure, err)
+	}
+
+	std, err := requiredEnv(spireTrustDomainEnv)
+	if err != nil {
+		return err
+	}
+	sasid, err := requiredEnv(spireApplicationSpiffeIdEnv)
+	if err != nil {
+		return err
+	}
+
+	envoyProxyConfigData := map[string]interface{}{
+		"Idx":         s.Stager.DepsIdx(),
+		"DepDir":      s.RuntimeDepDir(),
+		"SpiffeID":    sasid,
+		"TrustDomain": std,
+		// Envoy only reads PEM, whatever format the agent gets its bundle in
+		"TrustedCAPath":     s.pemTrustBundlePath(),
+		"EnvoyListenerPort": envoyListenerPort,
+	}
+	if err := s.telemetryData(envoyProxyConfigData); err != nil {
+		return err
+	}
+	err = envoyProxyConfig.Execute(envoyConfigFile, envoyProxyConfigData)
+	if err != nil {
+		return classify(TemplateRenderFailure, err)
+	}
+
+	err = envoyConfigFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *Supplier) CopySpireAgentConf() error {
 	conf := filepath.Join(s.Stager.DepDir(), "spire-agent.conf")
 	if _, err := libbuildpack.FileExists(conf); err != nil {
 		return err
 	}
 
-	f, err := os.Create(conf)
+	f, err := s.createGenerated(conf, configMode)
 	if err != nil {
 		return err
 	}
@@ -267,35 +455,71 @@ func (s *Supplier) CopySpireAgentConf() error {
 	s.Log.Info("Spire agent conf: %s", conf)
 
 	confTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "spire-agent-conf.tmpl")
-	t := template.Must(template.ParseFiles(confTmpl))
+	t, err := parseTemplate(confTmpl)
+	if err != nil {
+		return classify(TemplateRenderFailure, err)
+	}
 
-	ssa, err := utils.Env(spireServerAddressEnv)
+	ssa, err := requiredEnv(spireServerAddressEnv)
 	if err != nil {
 		return err
 	}
-	ssp, err := utils.Env(spireServerPortEnv)
+	ssp, err := requiredEnv(spireServerPortEnv)
 	if err != nil {
 		return err
 	}
-	std, err := utils.Env(spireTrustDomainEnv)
+	// the port is rendered unquoted
+	if port, err := strconv.Atoi(ssp); err != nil || port < 1 || port > 65535 {
+		return invalidConfigError("invalid `%s` value `%s`; expected a port number", spireServerPortEnv, ssp)
+	}
+	std, err := requiredEnv(spireTrustDomainEnv)
 	if err != nil {
 		return err
 	}
 
 	data := map[string]interface{}{
 		"Idx":                s.Stager.DepsIdx(),
+		"DepDir":             s.RuntimeDepDir(),
 		"SpireServerAddress": ssa,
 		"SpireServerPort":    ssp,
 		"TrustDomain":        std,
 	}
 
+	if err := s.trustBundleData(data); err != nil {
+		return err
+	}
+
+	if err := s.nodeAttestorData(data); err != nil {
+		return err
+	}
+
+	if err := s.healthChecksData(data); err != nil {
+		return err
+	}
+
+	if err := s.telemetryData(data); err != nil {
+		return err
+	}
+
+	keyManager, keyManagerDir, err := s.keyManager()
+	if err != nil {
+		return err
+	}
+	data["KeyManager"] = keyManager
+	data["KeyManagerDir"] = keyManagerDir
+
 	cfSvidStoreEnv := utils.EnvWithDefault(spireCloudFoundrySVIDStoreEnv, "false")
 	if strings.ToLower(cfSvidStoreEnv) == "true" {
+		plugin, ok := s.Plugins[svidStoreCfPlugin]
+		if !ok {
+			return pluginVerificationError("plugin `%s` is not installed", svidStoreCfPlugin)
+		}
 		data["CloudFoundrySVIDStoreEnabled"] = true
+		data["SvidStorePluginChecksum"] = plugin.SHA256
 	}
 	err = t.Execute(f, data)
 	if err != nil {
-		return err
+		return classify(TemplateRenderFailure, err)
 	}
 
 	err = f.Close()
@@ -306,7 +530,65 @@ func (s *Supplier) CopySpireAgentConf() error {
 	return nil
 }
 
-func (s *Supplier) Setup() error {
+// keyManager returns the KeyManager plugin and, for the disk one, the key
+// directory the agent uses at runtime. A relative directory is resolved in the
+// deps dir: it is checked, or created on Commit, at its staging path and
+// handed to the agent at its runtime path. An absolute directory is checked
+// if it exists at staging and otherwise only warned about.
+func (s *Supplier) keyManager() (string, string, error) {
+	keyManager := strings.ToLower(utils.EnvWithDefault(spireKeyManagerEnv, memoryKeyManager))
+	switch keyManager {
+	case memoryKeyManager:
+		return keyManager, "", nil
+	case diskKeyManager:
+	default:
+		return "", "", invalidConfigError("unsupported `%s` value `%s`; expected `%s` or `%s`", spireKeyManagerEnv, keyManager, memoryKeyManager, diskKeyManager)
+	}
+
+	dir := utils.EnvWithDefault(spireKeyManagerDirEnv, defaultKeyManagerDir)
+	if !filepath.IsAbs(dir) {
+		stagingDir := filepath.Join(s.Stager.DepDir(), dir)
+		if exists, err := libbuildpack.FileExists(stagingDir); err != nil {
+			return "", "", err
+		} else if !exists {
+			s.mkdirGenerated(stagingDir, 0700)
+		} else if err := checkKeyManagerDir(stagingDir); err != nil {
+			return "", "", err
+		}
+		return keyManager, filepath.Join(s.RuntimeDepDir(), dir), nil
+	}
+
+	if exists, err := libbuildpack.FileExists(dir); err != nil {
+		return "", "", err
+	} else if !exists {
+		s.Log.Warning("Key manager directory `%s` does not exist at staging; it must be writable by the agent at runtime", dir)
+		return keyManager, dir, nil
+	}
+
+	if err := checkKeyManagerDir(dir); err != nil {
+		return "", "", err
+	}
+	return keyManager, dir, nil
+}
+
+func checkKeyManagerDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return invalidConfigError("key manager directory `%s` is not a directory", dir)
+	}
+	if info.Mode().Perm()&0700 != 0700 {
+		return invalidConfigError("key manager directory `%s` must be readable, writable and searchable by its owner; mode is %s", dir, info.Mode().Perm())
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return invalidConfigError("key manager directory `%s` must not be accessible by group or others; mode is %s", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+func (s *Supplier) LoadConfig() error {
 	configPath := filepath.Join(s.Stager.BuildDir(), "buildpack.yml")
 	if exists, err := libbuildpack.FileExists(configPath); err != nil {
 		return err
@@ -316,6 +598,10 @@ func (s *Supplier) Setup() error {
 		}
 	}
 
+	return nil
+}
+
+func (s *Supplier) Setup() error {
 	var m struct {
 		VersionLines map[string]string `yaml:"version_lines"`
 	}
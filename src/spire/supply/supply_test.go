@@ -0,0 +1,174 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvoyBaseID(t *testing.T) {
+	app := `{"application_id":"2d2e3b5c-8c1f-4d4e-9c2a-6f0e5b1a7d31","application_name":"app"}`
+	other := `{"application_id":"9f1c0a7e-3b2d-4c5e-8a6f-1d2e3f4a5b6c","application_name":"app"}`
+
+	setEnv(t, map[string]string{"VCAP_APPLICATION": app})
+	appID := EnvoyBaseID()
+	setEnv(t, map[string]string{"VCAP_APPLICATION": other})
+	otherID := EnvoyBaseID()
+
+	tests := []struct {
+		name string
+		env  string
+		want uint32
+	}{
+		{name: "same app", env: app, want: appID},
+		{name: "no VCAP_APPLICATION", env: "", want: 1},
+		{name: "invalid VCAP_APPLICATION", env: "{", want: 1},
+		{name: "no application_id", env: `{"application_name":"app"}`, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{"VCAP_APPLICATION": tt.env})
+			if got := EnvoyBaseID(); got != tt.want {
+				t.Fatalf("expected base id %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	if appID == 0 || appID >= 65000 {
+		t.Fatalf("expected a base id between 1 and 64999, got %d", appID)
+	}
+	if appID == otherID {
+		t.Fatalf("expected different apps to get different base ids, both got %d", appID)
+	}
+}
+
+// pluginBuildpack copies the repository manifest.yml into a buildpack root
+// with each plugin as a local file. A plugin binary in binaries/plugins is
+// used as it is, checked against its manifest sha256; any other plugin gets a
+// fake binary and its entry the fake's sha256.
+func pluginBuildpack(t *testing.T) string {
+	t.Helper()
+	root := testutil.Buildpack(t)
+
+	var document map[string]interface{}
+	if err := libbuildpack.NewYAML().Load(testutil.RepoPath(t, "manifest.yml"), &document); err != nil {
+		t.Fatal(err)
+	}
+	deps, _ := document["dependencies"].([]interface{})
+	for _, dep := range deps {
+		entry := dep.(map[interface{}]interface{})
+		name := entry["name"].(string)
+		file := filepath.Join("dependencies", name)
+		if real, err := ioutil.ReadFile(testutil.RepoPath(t, "binaries", "plugins", name)); err == nil {
+			testutil.WriteFile(t, filepath.Join(root, file), string(real), 0755)
+		} else {
+			testutil.WriteFile(t, filepath.Join(root, file), testutil.Plugins[name], 0755)
+			entry["sha256"] = testutil.SHA256Hex(testutil.Plugins[name])
+		}
+		entry["file"] = file
+	}
+	if err := libbuildpack.NewYAML().Write(filepath.Join(root, "manifest.yml"), document); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestInstallSpireAgentPluginsFromManifest(t *testing.T) {
+	for _, stack := range []string{"cflinuxfs3", "cflinuxfs4"} {
+		t.Run(stack, func(t *testing.T) {
+			testutil.StagingEnv(t, map[string]string{"CF_STACK": stack})
+			staging := testutil.NewStaging(t, pluginBuildpack(t))
+			manifest := staging.Manifest(t)
+			s := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+			defer s.Abort()
+
+			if err := s.LoadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.InstallSpireAgentPlugins(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := s.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, name := range spirePlugins {
+				entry, err := manifest.GetEntry(libbuildpack.Dependency{Name: name, Version: s.Plugins[name].Version})
+				if err != nil {
+					t.Fatal(err)
+				}
+				path := filepath.Join(staging.DepDir(), "bin", name)
+				if s.Plugins[name].Path != path {
+					t.Errorf("expected %s at %s, got %s", name, path, s.Plugins[name].Path)
+				}
+				if err := libbuildpack.CheckSha256(path, entry.SHA256); err != nil {
+					t.Errorf("expected the installed %s to match the manifest: %v", name, err)
+				}
+				if info, err := os.Stat(path); err != nil || info.Mode()&0111 == 0 {
+					t.Errorf("expected an executable %s, got %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSpireAgentConfQuotesValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		want     []string
+		wantKind ErrorKind
+	}{
+		{
+			name: "plain values",
+			want: []string{`server_address    = "spire-server.example.org"`, "server_port       = 8081\n", `trust_domain      = "example.org"`},
+		},
+		{
+			name: "values with quotes and newlines",
+			env:  map[string]string{"SPIRE_SERVER_ADDRESS": "spire\"server", "SPIRE_TRUST_DOMAIN": "example.org\"\n}\nagent {"},
+			want: []string{`server_address    = "spire\"server"`, `trust_domain      = "example.org\"\n}\nagent {"`},
+		},
+		{
+			name:     "port that is not a number",
+			env:      map[string]string{"SPIRE_SERVER_PORT": "8081\nlog_level = \"DEBUG\""},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "port out of range",
+			env:      map[string]string{"SPIRE_SERVER_PORT": "65536"},
+			wantKind: InvalidConfiguration,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testutil.StagingEnv(t, tt.env)
+			staging := testutil.NewStaging(t, testutil.Buildpack(t))
+			manifest := staging.Manifest(t)
+			s := New(staging.Stager(manifest), manifest, libbuildpack.NewInstaller(manifest), staging.Log, &libbuildpack.Command{})
+
+			err := s.Run()
+			if tt.wantKind != 0 {
+				if ExitCode(err) != tt.wantKind.ExitCode() {
+					t.Fatalf("expected a %s error, got %v", tt.wantKind, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			conf := testutil.ReadFile(t, filepath.Join(staging.DepDir(), "spire-agent.conf"))
+			for _, want := range tt.want {
+				if !strings.Contains(conf, want) {
+					t.Errorf("expected %q in:\n%s", want, conf)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"strings"
+)
+
+const (
+	spireTelemetryEnv      = "SPIRE_TELEMETRY"
+	spireTelemetryPortEnv  = "SPIRE_TELEMETRY_PORT"
+	spireEnvoyAdminPortEnv = "SPIRE_ENVOY_ADMIN_PORT"
+
+	defaultTelemetryPort  = "9988"
+	defaultEnvoyAdminPort = "9901"
+
+	// envoyListenerPort is the port the Envoy outbound proxy listens on
+	envoyListenerPort = "8000"
+)
+
+type Telemetry struct {
+	Enabled        bool
+	AgentPort      string
+	EnvoyAdminPort string
+}
+
+func (t Telemetry) AgentMetricsURL() string {
+	return fmt.Sprintf("http://localhost:%s/metrics", t.AgentPort)
+}
+
+func (t Telemetry) EnvoyAdminURL() string {
+	return fmt.Sprintf("http://localhost:%s", t.EnvoyAdminPort)
+}
+
+func (t Telemetry) EnvoyMetricsURL() string {
+	return fmt.Sprintf("http://localhost:%s/stats/prometheus", t.EnvoyAdminPort)
+}
+
+func telemetry() (Telemetry, error) {
+	enabled := utils.EnvWithDefault(spireTelemetryEnv, "false")
+	if strings.ToLower(enabled) != "true" {
+		return Telemetry{}, checkLocalPorts(Telemetry{})
+	}
+
+	agentPort, err := localPort(spireTelemetryPortEnv, defaultTelemetryPort)
+	if err != nil {
+		return Telemetry{}, err
+	}
+	envoyAdminPort, err := localPort(spireEnvoyAdminPortEnv, defaultEnvoyAdminPort)
+	if err != nil {
+		return Telemetry{}, err
+	}
+
+	t := Telemetry{Enabled: true, AgentPort: agentPort, EnvoyAdminPort: envoyAdminPort}
+	if err := checkLocalPorts(t); err != nil {
+		return Telemetry{}, err
+	}
+	return t, nil
+}
+
+// checkLocalPorts fails when two of the localhost listeners the sidecars
+// open would bind the same port.
+func checkLocalPorts(t Telemetry) error {
+	hc, err := healthChecks()
+	if err != nil {
+		return err
+	}
+
+	listeners := []struct {
+		name    string
+		port    string
+		enabled bool
+	}{
+		{"`" + spireHealthChecksPortEnv + "`", hc.Port, hc.Enabled},
+		{"`" + spireTelemetryPortEnv + "`", t.AgentPort, t.Enabled},
+		{"`" + spireEnvoyAdminPortEnv + "`", t.EnvoyAdminPort, t.Enabled && EnvoyProxyEnabled()},
+		{"the Envoy proxy listener", envoyListenerPort, EnvoyProxyEnabled()},
+	}
+
+	used := map[string]string{}
+	for _, l := range listeners {
+		if !l.enabled {
+			continue
+		}
+		if other, ok := used[l.port]; ok {
+			return invalidConfigError("%s and %s must use different ports; both are %s", other, l.name, l.port)
+		}
+		used[l.port] = l.name
+	}
+	return nil
+}
+
+func (s *Supplier) telemetryData(data map[string]interface{}) error {
+	t, err := telemetry()
+	if err != nil {
+		return err
+	}
+	if !t.Enabled {
+		return nil
+	}
+
+	data["TelemetryEnabled"] = true
+	data["TelemetryPort"] = t.AgentPort
+	data["EnvoyAdminPort"] = t.EnvoyAdminPort
+	return nil
+}
+
+func (s *Supplier) WriteTelemetryProfileD() error {
+	t, err := telemetry()
+	if err != nil {
+		return err
+	}
+	if !t.Enabled {
+		return nil
+	}
+
+	script := fmt.Sprintf("export SPIRE_AGENT_METRICS_URL=%s\n", t.AgentMetricsURL())
+	if s.EnvoyProxy() {
+		script += fmt.Sprintf("export ENVOY_ADMIN_URL=%s\nexport ENVOY_METRICS_URL=%s\n", t.EnvoyAdminURL(), t.EnvoyMetricsURL())
+	}
+
+	return s.writeProfileD("spire-telemetry.sh", script)
+}
@@ -0,0 +1,84 @@
+package supply
+
+import (
+	"testing"
+)
+
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func TestTelemetryPortCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{spireTelemetryEnv: "true", spireHealthChecksEnv: "true", spireEnvoyProxyEnv: "true"},
+		},
+		{
+			name:    "telemetry and envoy admin",
+			env:     map[string]string{spireTelemetryEnv: "true", spireTelemetryPortEnv: "9000", spireEnvoyAdminPortEnv: "9000", spireEnvoyProxyEnv: "true"},
+			wantErr: true,
+		},
+		{
+			name:    "health checks and telemetry",
+			env:     map[string]string{spireTelemetryEnv: "true", spireTelemetryPortEnv: "9000", spireHealthChecksEnv: "true", spireHealthChecksPortEnv: "9000"},
+			wantErr: true,
+		},
+		{
+			name:    "health checks and envoy admin",
+			env:     map[string]string{spireTelemetryEnv: "true", spireEnvoyAdminPortEnv: "9000", spireHealthChecksEnv: "true", spireHealthChecksPortEnv: "9000", spireEnvoyProxyEnv: "true"},
+			wantErr: true,
+		},
+		{
+			name: "envoy admin without envoy",
+			env:  map[string]string{spireTelemetryEnv: "true", spireEnvoyAdminPortEnv: "9000", spireHealthChecksEnv: "true", spireHealthChecksPortEnv: "9000", spireEnvoyProxyEnv: "false"},
+		},
+		{
+			name:    "telemetry and envoy listener",
+			env:     map[string]string{spireTelemetryEnv: "true", spireTelemetryPortEnv: envoyListenerPort, spireEnvoyProxyEnv: "true"},
+			wantErr: true,
+		},
+		{
+			name:    "envoy admin and envoy listener",
+			env:     map[string]string{spireTelemetryEnv: "true", spireEnvoyAdminPortEnv: envoyListenerPort, spireEnvoyProxyEnv: "true"},
+			wantErr: true,
+		},
+		{
+			name:    "health checks and envoy listener without telemetry",
+			env:     map[string]string{spireHealthChecksEnv: "true", spireHealthChecksPortEnv: envoyListenerPort, spireEnvoyProxyEnv: "true"},
+			wantErr: true,
+		},
+		{
+			name: "envoy listener port without envoy",
+			env:  map[string]string{spireTelemetryEnv: "true", spireTelemetryPortEnv: envoyListenerPort, spireEnvoyProxyEnv: "false"},
+		},
+		{
+			name: "health checks disabled",
+			env:  map[string]string{spireTelemetryEnv: "true", spireTelemetryPortEnv: "9000", spireHealthChecksEnv: "false", spireHealthChecksPortEnv: "9000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				spireTelemetryEnv: "", spireTelemetryPortEnv: "", spireEnvoyAdminPortEnv: "",
+				spireHealthChecksEnv: "", spireHealthChecksPortEnv: "", spireEnvoyProxyEnv: "",
+			})
+			setEnv(t, tt.env)
+
+			_, err := telemetry()
+			if tt.wantErr && ExitCode(err) != InvalidConfiguration.ExitCode() {
+				t.Fatalf("expected an invalid configuration error, got %v", err)
+			} else if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package supply
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	spireTrustBundleEnv                  = "SPIRE_TRUST_BUNDLE"
+	spireTrustBundleFileEnv              = "SPIRE_TRUST_BUNDLE_FILE"
+	spireTrustBundleExpiryWarningDaysEnv = "SPIRE_TRUST_BUNDLE_EXPIRY_WARNING_DAYS"
+
+	trustBundleCredential    = "trust_bundle"
+	defaultTrustBundleFile   = ".spire/bundle.pem"
+	defaultExpiryWarningDays = "30"
+	trustBundleName          = "bundle.crt"
+)
+
+func (s *Supplier) InstallTrustBundle() error {
+	content, source, err := s.trustBundle()
+	if err != nil {
+		return err
+	}
+
+	sourceFormat := detectBundleFormat(content)
+	certs, err := parseBundle(content, sourceFormat)
+	if err != nil {
+		return invalidConfigError("trust bundle from %s: %s", source, err.Error())
+	}
+	if err := s.checkCertificates(certs, source, true); err != nil {
+		return err
+	}
+	s.Log.Info("Using %s trust bundle from %s with %d certificate(s)", sourceFormat, source, len(certs))
+
+	format, err := trustBundleFormat()
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = sourceFormat
+	}
+
+	certsDir := filepath.Join(s.Stager.DepDir(), "certificates")
+	if err := s.writeGenerated(filepath.Join(certsDir, trustBundleName), encodeCertificates(certs), certificateMode); err != nil {
+		return err
+	}
+
+	spiffePath := filepath.Join(certsDir, spiffeBundleName)
+	if format != spiffeBundleFormat {
+		if s.pendingPath(spiffePath) != "" {
+			s.removeGenerated(spiffePath)
+		}
+		return nil
+	}
+
+	// A SPIFFE bundle source is kept as is so JWT authorities and refresh
+	// hints reach the agent.
+	if sourceFormat != spiffeBundleFormat {
+		if content, err = encodeSpiffeBundle(certs); err != nil {
+			return invalidConfigError("trust bundle from %s: %s", source, err.Error())
+		}
+	}
+	return s.writeGenerated(spiffePath, content, certificateMode)
+}
+
+func (s *Supplier) trustBundle() ([]byte, string, error) {
+	if bundle := utils.EnvWithDefault(spireTrustBundleEnv, ""); bundle != "" {
+		return []byte(bundle), fmt.Sprintf("`%s` environment variable", spireTrustBundleEnv), nil
+	}
+
+	bundle, found, err := utils.ServiceCredential(trustBundleCredential)
+	if err != nil {
+		return nil, "", invalidConfigError("%s", err.Error())
+	} else if found {
+		return []byte(bundle), fmt.Sprintf("service binding credential `%s`", trustBundleCredential), nil
+	}
+
+	appFile := utils.EnvWithDefault(spireTrustBundleFileEnv, defaultTrustBundleFile)
+	appPath := filepath.Join(s.Stager.BuildDir(), appFile)
+	if exists, err := libbuildpack.FileExists(appPath); err != nil {
+		return nil, "", err
+	} else if exists {
+		content, err := ioutil.ReadFile(appPath)
+		return content, fmt.Sprintf("app file `%s`", appFile), err
+	} else if appFile != defaultTrustBundleFile {
+		return nil, "", missingConfigError("trust bundle file `%s` set in `%s` does not exist in the app", appFile, spireTrustBundleFileEnv)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(s.Manifest.RootDir(), "certificates", trustBundleName))
+	return content, "buildpack", err
+}
+
+// parseCertificates returns the PEM encoded certificates in content. Other
+// PEM blocks and surrounding text are skipped unless strict is set, which
+// fails on anything but certificates.
+func parseCertificates(content []byte, strict bool) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := content
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			if strict {
+				return nil, fmt.Errorf("found a `%s` PEM block, only certificates are allowed", block.Type)
+			}
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if strict && len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("found data that is not PEM encoded")
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificates found")
+	}
+	return certs, nil
+}
+
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, cert := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return out
+}
+
+// checkCertificates fails on certificates that are not usable as trust
+// anchors when strict is set and only warns otherwise.
+func (s *Supplier) checkCertificates(certs []*x509.Certificate, source string, strict bool) error {
+	days, err := strconv.Atoi(utils.EnvWithDefault(spireTrustBundleExpiryWarningDaysEnv, defaultExpiryWarningDays))
+	if err != nil || days < 0 {
+		return invalidConfigError("invalid `%s` value; expected a number of days", spireTrustBundleExpiryWarningDaysEnv)
+	}
+
+	now := time.Now()
+	for _, cert := range certs {
+		var problem string
+		switch {
+		case !cert.BasicConstraintsValid || !cert.IsCA:
+			problem = "is not a CA certificate"
+		case now.After(cert.NotAfter):
+			problem = fmt.Sprintf("expired at %s", cert.NotAfter.Format(time.RFC3339))
+		case now.Before(cert.NotBefore):
+			problem = fmt.Sprintf("is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+		}
+
+		if problem != "" {
+			if strict {
+				return invalidConfigError("certificate `%s` in trust bundle from %s %s", cert.Subject, source, problem)
+			}
+			s.Log.Warning("Certificate `%s` from %s %s", cert.Subject, source, problem)
+			continue
+		}
+
+		if cert.NotAfter.Sub(now) < time.Duration(days)*24*time.Hour {
+			s.Log.Warning("Certificate `%s` from %s expires at %s", cert.Subject, source, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package supply
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	spireTrustBundleURLEnv       = "SPIRE_TRUST_BUNDLE_URL"
+	spireTrustBundleFormatEnv    = "SPIRE_TRUST_BUNDLE_FORMAT"
+	spireTrustBundleSHA256Env    = "SPIRE_TRUST_BUNDLE_SHA256"
+	spireTrustBundlePublicKeyEnv = "SPIRE_TRUST_BUNDLE_PUBLIC_KEY"
+
+	trustBundleSignatureSuffix = ".sig"
+	trustBundleFetchTimeout    = 10 * time.Second
+	maxTrustBundleSize         = 1 << 20
+)
+
+type TrustBundleURL struct {
+	URL    string
+	Format string
+}
+
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (s *Supplier) httpClient() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return &http.Client{Timeout: trustBundleFetchTimeout}
+}
+
+func (s *Supplier) VerifyTrustBundleURL() error {
+	s.TrustBundleURL = nil
+
+	url := utils.EnvWithDefault(spireTrustBundleURLEnv, "")
+	if url == "" {
+		return nil
+	}
+	// the agent only fetches trust_bundle_url over TLS
+	if !strings.HasPrefix(url, "https://") {
+		return invalidConfigError("`%s` must be an https URL", spireTrustBundleURLEnv)
+	}
+
+	format, err := trustBundleFormat()
+	if err != nil {
+		return err
+	}
+
+	pinnedSHA256 := strings.ToLower(utils.EnvWithDefault(spireTrustBundleSHA256Env, ""))
+	publicKey := utils.EnvWithDefault(spireTrustBundlePublicKeyEnv, "")
+	if pinnedSHA256 == "" && publicKey == "" {
+		return missingConfigError("`%s` requires `%s` or `%s` to pin the bundle", spireTrustBundleURLEnv, spireTrustBundleSHA256Env, spireTrustBundlePublicKeyEnv)
+	}
+
+	content, err := s.fetch(url)
+	if err != nil {
+		if _, ok := err.(*unreachableError); ok {
+			s.Log.Warning("Trust bundle URL %s is not reachable (%s); falling back to the bundled trust bundle", url, err.Error())
+			return nil
+		}
+		return err
+	}
+
+	if pinnedSHA256 != "" {
+		sum := sha256.Sum256(content)
+		if actual := hex.EncodeToString(sum[:]); actual != pinnedSHA256 {
+			return invalidConfigError("trust bundle from %s has sha256 %s, expected %s", url, actual, pinnedSHA256)
+		}
+	}
+
+	if publicKey != "" {
+		if err := s.verifyTrustBundleSignature(url, content, publicKey); err != nil {
+			return err
+		}
+	}
+
+	if format == "" {
+		format = detectBundleFormat(content)
+	}
+	certs, err := parseBundle(content, format)
+	if err != nil {
+		return invalidConfigError("trust bundle from %s: %s", url, err.Error())
+	}
+	if err := s.checkCertificates(certs, url, true); err != nil {
+		return err
+	}
+
+	s.Log.Info("Agent will bootstrap from trust bundle URL %s", url)
+	s.TrustBundleURL = &TrustBundleURL{URL: url, Format: format}
+	return nil
+}
+
+func (s *Supplier) verifyTrustBundleSignature(url string, content []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return invalidConfigError("`%s` must be a base64 encoded ed25519 public key", spireTrustBundlePublicKeyEnv)
+	}
+
+	encoded, err := s.fetch(url + trustBundleSignatureSuffix)
+	if err != nil {
+		return invalidConfigError("can't fetch trust bundle signature: %s", err.Error())
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return invalidConfigError("trust bundle signature from %s%s is not base64 encoded", url, trustBundleSignatureSuffix)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), content, signature) {
+		return invalidConfigError("trust bundle from %s does not match its signature", url)
+	}
+	return nil
+}
+
+func (s *Supplier) fetch(url string) ([]byte, error) {
+	resp, err := s.httpClient().Get(url)
+	if err != nil {
+		if unreachable(err) {
+			return nil, &unreachableError{err: err}
+		}
+		return nil, invalidConfigError("can't fetch %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, invalidConfigError("%s returned status %d", url, resp.StatusCode)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTrustBundleSize+1))
+	if err != nil {
+		if unreachable(err) {
+			return nil, &unreachableError{err: err}
+		}
+		return nil, invalidConfigError("can't read %s: %s", url, err.Error())
+	}
+	if len(content) > maxTrustBundleSize {
+		return nil, invalidConfigError("%s is larger than %d bytes", url, maxTrustBundleSize)
+	}
+	return content, nil
+}
+
+// unreachable tells whether a fetch failed to connect or timed out, the only
+// failures the bundled trust bundle is a fallback for. A server that answers
+// with anything else is misconfigured and fails the staging.
+func unreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
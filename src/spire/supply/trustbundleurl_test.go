@@ -0,0 +1,183 @@
+package supply
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/testutil"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testCA(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeCertificates([]*x509.Certificate{cert})
+}
+
+func TestVerifyTrustBundleURL(t *testing.T) {
+	bundle := testCA(t)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, bundle))
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bundle.pem":
+			w.Write(bundle)
+		case "/bundle.pem.sig":
+			w.Write([]byte(signature))
+		case "/garbage.pem":
+			w.Write([]byte("not a bundle"))
+		case "/large.pem":
+			w.Write(make([]byte, maxTrustBundleSize+1))
+		case "/error.pem":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case "/slow.pem":
+			time.Sleep(500 * time.Millisecond)
+			w.Write(bundle)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := *server.Client()
+	client.Timeout = 100 * time.Millisecond
+
+	closed := httptest.NewTLSServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantURL  bool
+		wantKind ErrorKind
+	}{
+		{
+			name:    "reachable with pinned sha256",
+			env:     map[string]string{spireTrustBundleURLEnv: server.URL + "/bundle.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+			wantURL: true,
+		},
+		{
+			name:    "reachable with signature",
+			env:     map[string]string{spireTrustBundleURLEnv: server.URL + "/bundle.pem", spireTrustBundlePublicKeyEnv: base64.StdEncoding.EncodeToString(publicKey)},
+			wantURL: true,
+		},
+		{
+			name:     "sha256 mismatch",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/bundle.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string([]byte("other")))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "signature by another key",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/bundle.pem", spireTrustBundlePublicKeyEnv: base64.StdEncoding.EncodeToString(otherKey)},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "invalid body",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/garbage.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string([]byte("not a bundle")))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name: "unreachable falls back",
+			env:  map[string]string{spireTrustBundleURLEnv: closedURL + "/bundle.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+		},
+		{
+			name: "timeout falls back",
+			env:  map[string]string{spireTrustBundleURLEnv: server.URL + "/slow.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+		},
+		{
+			name:     "not found",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/missing.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "server error",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/error.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "oversize body",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/large.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(make([]byte, maxTrustBundleSize+1)))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "plain http",
+			env:      map[string]string{spireTrustBundleURLEnv: "http://localhost/bundle.pem", spireTrustBundleSHA256Env: testutil.SHA256Hex(string(bundle))},
+			wantKind: InvalidConfiguration,
+		},
+		{
+			name:     "not pinned",
+			env:      map[string]string{spireTrustBundleURLEnv: server.URL + "/bundle.pem"},
+			wantKind: MissingConfiguration,
+		},
+		{
+			name: "not configured",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{
+				spireTrustBundleURLEnv: "", spireTrustBundleSHA256Env: "", spireTrustBundlePublicKeyEnv: "", spireTrustBundleFormatEnv: "",
+			})
+			setEnv(t, tt.env)
+
+			s := &Supplier{Log: libbuildpack.NewLogger(ioutil.Discard), HTTPClient: &client}
+			err := s.VerifyTrustBundleURL()
+
+			if tt.wantKind != 0 {
+				if ExitCode(err) != tt.wantKind.ExitCode() {
+					t.Fatalf("expected a %s error, got %v", tt.wantKind, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantURL && (s.TrustBundleURL == nil || s.TrustBundleURL.URL != tt.env[spireTrustBundleURLEnv] || s.TrustBundleURL.Format != pemBundleFormat) {
+				t.Fatalf("expected the agent to bootstrap from %s as pem, got %+v", tt.env[spireTrustBundleURLEnv], s.TrustBundleURL)
+			}
+			if !tt.wantURL && s.TrustBundleURL != nil {
+				t.Fatalf("expected the bundled trust bundle, got %+v", s.TrustBundleURL)
+			}
+		})
+	}
+}
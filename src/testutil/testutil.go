@@ -0,0 +1,194 @@
+// Package testutil holds the file helpers the package tests share.
+package testutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// WriteFile writes content to path with mode, creating the parent
+// directories, and fails the test on error.
+func WriteFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ReadFile returns the content of path and fails the test on error.
+func ReadFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// SHA256Hex returns the hex encoded SHA-256 of content.
+func SHA256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// CopyDir copies the regular files directly under src to dst.
+func CopyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(src, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		WriteFile(t, filepath.Join(dst, file.Name()), string(content), file.Mode())
+	}
+}
+
+// RepoPath joins path to the repository root, found as the closest parent
+// of the test's working directory holding go.mod.
+func RepoPath(t *testing.T, path ...string) string {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return filepath.Join(append([]string{dir}, path...)...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatal("no go.mod above the test directory")
+		}
+		dir = parent
+	}
+}
+
+// Plugins are the SPIRE plugin dependencies of a Buildpack and the content
+// of their fake binaries.
+var Plugins = map[string]string{"cf_iic": "cf_iic plugin", "svidstore-cf": "svidstore-cf plugin"}
+
+const buildpackManifest = `language: spire-agent
+default_versions:
+  - name: cf_iic
+    version: 1.0.x
+  - name: svidstore-cf
+    version: 1.0.x
+dependencies:
+  - name: cf_iic
+    version: 1.0.0
+    uri: https://example.com/plugins/cf_iic
+    file: dependencies/cf_iic-1.0.0/cf_iic
+    sha256: %s
+    cf_stacks:
+      - cflinuxfs3
+      - cflinuxfs4
+  - name: svidstore-cf
+    version: 1.0.0
+    uri: https://example.com/plugins/svidstore-cf
+    file: dependencies/svidstore-cf-1.0.0/svidstore-cf
+    sha256: %s
+    cf_stacks:
+      - cflinuxfs3
+      - cflinuxfs4
+`
+
+// Buildpack lays out an unsigned, cached buildpack root with the repository
+// templates and certificates, a fake spire-agent that prints its version and
+// the Plugins as local dependencies.
+func Buildpack(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"templates", "certificates"} {
+		CopyDir(t, RepoPath(t, dir), filepath.Join(root, dir))
+	}
+	WriteFile(t, filepath.Join(root, "manifest.yml"), fmt.Sprintf(buildpackManifest, SHA256Hex(Plugins["cf_iic"]), SHA256Hex(Plugins["svidstore-cf"])), 0644)
+	WriteFile(t, filepath.Join(root, "VERSION"), "1.0.0\n", 0644)
+	WriteFile(t, filepath.Join(root, "binaries", "spire-agent"), "#!/bin/sh\necho 1.9.0\n", 0755)
+	for name, content := range Plugins {
+		WriteFile(t, filepath.Join(root, "dependencies", name+"-1.0.0", name), content, 0755)
+	}
+	return root
+}
+
+// Staging is a CF staging of a buildpack root into temp dirs with deps index
+// 0.
+type Staging struct {
+	BuildpackDir string
+	BuildDir     string
+	CacheDir     string
+	DepsDir      string
+	ProfileDir   string
+	Log          *libbuildpack.Logger
+}
+
+// NewStaging creates the dirs of a staging of the buildpack at buildpackDir.
+func NewStaging(t *testing.T, buildpackDir string) *Staging {
+	t.Helper()
+	s := &Staging{
+		BuildpackDir: buildpackDir,
+		BuildDir:     t.TempDir(),
+		CacheDir:     t.TempDir(),
+		DepsDir:      t.TempDir(),
+		ProfileDir:   t.TempDir(),
+		Log:          libbuildpack.NewLogger(ioutil.Discard),
+	}
+	if err := os.MkdirAll(s.DepDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// DepDir is the deps dir of the staged buildpack.
+func (s *Staging) DepDir() string {
+	return filepath.Join(s.DepsDir, "0")
+}
+
+// Manifest loads the buildpack manifest.yml for CF_STACK.
+func (s *Staging) Manifest(t *testing.T) *libbuildpack.Manifest {
+	t.Helper()
+	manifest, err := libbuildpack.NewManifest(s.BuildpackDir, s.Log, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// Stager returns the libbuildpack stager the supply and finalize CLIs use.
+func (s *Staging) Stager(manifest *libbuildpack.Manifest) *libbuildpack.Stager {
+	return libbuildpack.NewStager([]string{s.BuildDir, s.CacheDir, s.DepsDir, "0", s.ProfileDir}, s.Log, manifest)
+}
+
+// StagingEnv sets the environment of a minimal staging of an unsigned
+// buildpack on cflinuxfs4, then env on top of it.
+func StagingEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for key, value := range map[string]string{
+		"CF_STACK":                       "cflinuxfs4",
+		"SPIRE_SERVER_ADDRESS":           "spire-server.example.org",
+		"SPIRE_SERVER_PORT":              "8081",
+		"SPIRE_TRUST_DOMAIN":             "example.org",
+		"SPIRE_ALLOW_UNSIGNED_BUILDPACK": "true",
+	} {
+		t.Setenv(key, value)
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"sort"
+)
+
+// SortedKeys returns the keys of m in sorted order.
+func SortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type service struct {
+	Name        string                 `json:"name"`
+	Label       string                 `json:"label"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+func ServiceCredential(key string) (string, bool, error) {
+	raw := strings.TrimSpace(os.Getenv("VCAP_SERVICES"))
+	if raw == "" {
+		return "", false, nil
+	}
+
+	var services map[string][]service
+	if err := json.Unmarshal([]byte(raw), &services); err != nil {
+		return "", false, fmt.Errorf("can't parse `VCAP_SERVICES`: %s", err.Error())
+	}
+
+	for _, instances := range services {
+		for _, instance := range instances {
+			if value, ok := instance.Credentials[key].(string); ok && strings.TrimSpace(value) != "" {
+				return strings.TrimSpace(value), true, nil
+			}
+		}
+	}
+
+	return "", false, nil
+}